@@ -0,0 +1,46 @@
+package floodsub
+
+import (
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+type blacklistReq struct {
+	peer      peer.ID
+	blacklist bool
+}
+
+// BlacklistPeer stops all processing of RPCs from a peer. If we are
+// connected to the peer, its outbound stream is closed, and we refuse new
+// streams from it until it is removed from the blacklist again.
+func (p *PubSub) BlacklistPeer(pid peer.ID) {
+	p.setBlacklisted(pid, true)
+}
+
+// UnblacklistPeer removes a peer from the blacklist. The peer is picked up
+// again the next time it connects to us.
+func (p *PubSub) UnblacklistPeer(pid peer.ID) {
+	p.setBlacklisted(pid, false)
+}
+
+func (p *PubSub) setBlacklisted(pid peer.ID, blacklist bool) {
+	select {
+	case p.blacklistCh <- &blacklistReq{peer: pid, blacklist: blacklist}:
+	case <-p.done:
+	}
+}
+
+// handleBlacklist updates the blacklist, dropping the peer if we have a
+// connection to it.
+// Only called from processLoop.
+func (p *PubSub) handleBlacklist(req *blacklistReq) {
+	if !req.blacklist {
+		delete(p.blacklist, req.peer)
+		return
+	}
+
+	p.blacklist[req.peer] = struct{}{}
+	if _, ok := p.peers[req.peer]; ok {
+		p.log.Infof("dropping blacklisted peer %s", req.peer)
+		p.handleDeadPeer(req.peer)
+	}
+}
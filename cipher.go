@@ -0,0 +1,73 @@
+package floodsub
+
+import (
+	"fmt"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+)
+
+// TopicCipher encrypts and decrypts the data of messages on a topic. The
+// scheme and key management are up to the implementation.
+type TopicCipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// WithTopicCipher encrypts the data of messages we publish on topic with c,
+// and decrypts the data of messages on topic before validating and
+// delivering them. Messages failing to decrypt are dropped and counted in
+// Stats.DroppedDecryption. Only the data is encrypted and the wire format
+// stays the same, so nodes without the cipher relay the ciphertext as usual.
+// Messages on an encrypted topic can't carry other topics.
+func WithTopicCipher(topic string, c TopicCipher) Option {
+	return func(p *PubSub) error {
+		if c == nil {
+			return fmt.Errorf("cipher for topic %s must not be nil", topic)
+		}
+
+		p.topicCiphers[topic] = c
+		return nil
+	}
+}
+
+// cipherFor returns the cipher for a message with the given topics, or nil
+// if none of them is encrypted. It fails if the message mixes an encrypted
+// topic with other topics.
+func (p *PubSub) cipherFor(topics []string) (TopicCipher, error) {
+	for _, t := range topics {
+		c, ok := p.topicCiphers[t]
+		if !ok {
+			continue
+		}
+
+		if len(topics) > 1 {
+			return nil, fmt.Errorf("encrypted topic %s can't be combined with other topics", t)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// decrypt returns pmsg with its data decrypted if it is on an encrypted
+// topic, or pmsg itself otherwise. The returned bool is false if the message
+// couldn't be decrypted.
+func (p *PubSub) decrypt(pmsg *pb.Message) (*pb.Message, bool) {
+	c, err := p.cipherFor(pmsg.GetTopicIDs())
+	if err != nil {
+		p.log.Infof("dropping message from %s: %s", pmsg.GetFrom(), err)
+		return nil, false
+	}
+	if c == nil {
+		return pmsg, true
+	}
+
+	data, err := c.Decrypt(pmsg.GetData())
+	if err != nil {
+		p.log.Infof("dropping message from %s: decrypting: %s", pmsg.GetFrom(), err)
+		return nil, false
+	}
+
+	dmsg := *pmsg
+	dmsg.Data = data
+	return &dmsg, true
+}
@@ -4,6 +4,11 @@ import (
 	"bufio"
 	"context"
 	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pb "github.com/libp2p/go-floodsub/pb"
 
@@ -22,38 +27,78 @@ func (p *PubSub) getHelloPacket() *RPC {
 		}
 		rpc.Subscriptions = append(rpc.Subscriptions, as)
 	}
+	for t := range p.relayTopics {
+		if _, ok := p.myTopics[t]; ok {
+			continue
+		}
+		rpc.Subscriptions = append(rpc.Subscriptions, &pb.RPC_SubOpts{
+			Topicid:   proto.String(t),
+			Subscribe: proto.Bool(true),
+		})
+	}
+	rpc.Hello = p.helloExt
 	return &rpc
 }
 
 func (p *PubSub) handleNewStream(s inet.Stream) {
 	defer s.Close()
+	if !p.trackStream(s) {
+		return
+	}
+	defer p.untrackStream(s)
+
+	_, direct := p.directPeers[s.Conn().RemotePeer()]
+	r := ggio.NewDelimitedReader(s, p.maxMessageSize)
+
+	// our share of the fair queue, if enabled
+	var slots chan struct{}
+	if p.fair != nil {
+		slots = make(chan struct{}, p.fair.size)
+	}
 
-	r := ggio.NewDelimitedReader(s, 1<<20)
 	for {
+		if p.idleTimeout > 0 && !direct {
+			s.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+
 		rpc := new(RPC)
 		err := r.ReadMsg(&rpc.RPC)
 		if err != nil {
-			if err != io.EOF {
-				log.Errorf("error reading rpc from %s: %s", s.Conn().RemotePeer(), err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				p.log.Infof("no rpc from %s within %s, dropping peer", s.Conn().RemotePeer(), p.idleTimeout)
+				select {
+				case p.peerDead <- deadPeer{pid: s.Conn().RemotePeer()}:
+				case <-p.done:
+				}
+			} else if err == io.ErrShortBuffer {
+				p.log.Warningf("rpc from %s exceeds the maximum message size of %d bytes, closing stream", s.Conn().RemotePeer(), p.maxMessageSize)
+			} else if err != io.EOF {
+				p.log.Errorf("error reading rpc from %s: %s", s.Conn().RemotePeer(), err)
 			}
 			return
 		}
 
 		rpc.from = s.Conn().RemotePeer()
-		select {
-		case p.incoming <- rpc:
-		case <-p.ctx.Done():
+		if !p.pushIncoming(rpc, slots) {
 			return
 		}
 	}
 }
 
-func (p *PubSub) handleSendingMessages(ctx context.Context, s inet.Stream, outgoing <-chan *RPC) {
+func (p *PubSub) handleSendingMessages(ctx context.Context, s inet.Stream, outgoing <-chan *RPC, subs *subQueue) {
+	defer p.writers.Done()
+	defer p.untrackStream(s)
+
 	var dead bool
-	bufw := bufio.NewWriter(s)
+	bufw := bufio.NewWriter(&retryWriter{p: p, ctx: ctx, w: s})
 	wc := ggio.NewDelimitedWriter(bufw)
 
 	writeMsg := func(msg proto.Message) error {
+		if !p.acquireSend() {
+			return ErrPubSubClosed
+		}
+		defer p.releaseSend()
+
 		err := wc.WriteMsg(msg)
 		if err != nil {
 			return err
@@ -62,7 +107,16 @@ func (p *PubSub) handleSendingMessages(ctx context.Context, s inet.Stream, outgo
 		return bufw.Flush()
 	}
 
-	defer wc.Close()
+	notifyDead := func() {
+		go func() {
+			select {
+			case p.peerDead <- deadPeer{pid: s.Conn().RemotePeer(), outgoing: outgoing}:
+			case <-p.done:
+			}
+		}()
+	}
+
+	defer s.Close()
 	for {
 		select {
 		case rpc, ok := <-outgoing:
@@ -71,16 +125,29 @@ func (p *PubSub) handleSendingMessages(ctx context.Context, s inet.Stream, outgo
 			}
 			if dead {
 				// continue in order to drain messages
+				atomic.AddUint64(&p.stats.DroppedPeerGone, uint64(len(rpc.Publish)))
 				continue
 			}
 
 			err := writeMsg(&rpc.RPC)
 			if err != nil {
-				log.Warningf("writing message to %s: %s", s.Conn().RemotePeer(), err)
+				p.log.Warningf("writing message to %s: %s", s.Conn().RemotePeer(), err)
+				atomic.AddUint64(&p.stats.DroppedPeerGone, uint64(len(rpc.Publish)))
 				dead = true
-				go func() {
-					p.peerDead <- s.Conn().RemotePeer()
-				}()
+				notifyDead()
+			}
+
+		case <-subs.ready:
+			rpc := subs.pop()
+			if dead || rpc == nil {
+				continue
+			}
+
+			err := writeMsg(&rpc.RPC)
+			if err != nil {
+				p.log.Warningf("writing subscriptions to %s: %s", s.Conn().RemotePeer(), err)
+				dead = true
+				notifyDead()
 			}
 
 		case <-ctx.Done():
@@ -89,6 +156,210 @@ func (p *PubSub) handleSendingMessages(ctx context.Context, s inet.Stream, outgo
 	}
 }
 
+// maxWriteRetries is how often a write to a peer failing with a temporary
+// error is retried before the peer is given up on
+const maxWriteRetries = 3
+
+// writeRetryDelay is how long we wait on average before the first retry of
+// a write. The delay doubles with every further retry.
+const writeRetryDelay = time.Millisecond * 10
+
+// retryWriter retries writes to w failing with a temporary error, resuming
+// after what was written already so the stream stays intact.
+type retryWriter struct {
+	p   *PubSub
+	ctx context.Context
+	w   io.Writer
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	var written int
+	delay := writeRetryDelay
+	for retries := 0; ; retries++ {
+		n, err := rw.w.Write(b[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+
+		if retries == maxWriteRetries || !isTemporary(err) {
+			return written, err
+		}
+
+		rw.p.log.Debugf("retrying write after temporary error: %s", err)
+		count(&rw.p.stats.WriteRetries)
+
+		select {
+		case <-time.After(jitter(delay)):
+		case <-rw.ctx.Done():
+			return written, err
+		}
+		delay *= 2
+	}
+}
+
+// jitter returns a random duration between d/2 and 3d/2, so writers hit by
+// the same hiccup don't retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// isTemporary returns whether err is worth retrying a write for. Timeouts
+// aren't: we set write deadlines to give up on peers.
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary() && !ne.Timeout()
+}
+
+// trackStream registers s to be closed on shutdown. It returns false if the
+// streams have already been closed, in which case s must not be used.
+func (p *PubSub) trackStream(s inet.Stream) bool {
+	p.streamsLk.Lock()
+	defer p.streamsLk.Unlock()
+
+	if p.streams == nil {
+		return false
+	}
+	p.streams[s] = struct{}{}
+	return true
+}
+
+func (p *PubSub) untrackStream(s inet.Stream) {
+	p.streamsLk.Lock()
+	defer p.streamsLk.Unlock()
+
+	delete(p.streams, s)
+}
+
+// resetStreams closes all tracked streams, but unlike closeStreams keeps
+// tracking new ones.
+func (p *PubSub) resetStreams() {
+	p.streamsLk.Lock()
+	streams := p.streams
+	p.streams = make(map[inet.Stream]struct{})
+	p.streamsLk.Unlock()
+
+	for s := range streams {
+		s.Close()
+	}
+}
+
+// closeStreams closes all tracked streams, and makes trackStream refuse
+// new ones.
+func (p *PubSub) closeStreams() {
+	p.streamsLk.Lock()
+	streams := p.streams
+	p.streams = nil
+	p.streamsLk.Unlock()
+
+	for s := range streams {
+		s.Close()
+	}
+}
+
+// subQueue holds the subscription changes waiting to be announced to a peer.
+// Unlike messages they are never dropped: changes made while the writer is
+// busy are merged, the latest one per topic winning, and written together.
+type subQueue struct {
+	lk      sync.Mutex
+	pending map[string]bool
+
+	// hello is sent along with the first changes, if not nil
+	hello []byte
+
+	// exchange holds the peers to tell about, at most maxExchangePeers
+	exchange []*pb.RPC_PeerExchange
+
+	// ready is signalled when there are pending changes
+	ready chan struct{}
+}
+
+func newSubQueue() *subQueue {
+	return &subQueue{
+		pending: make(map[string]bool),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// pushHello queues the hello packet, which goes out even if it doesn't
+// announce anything
+func (q *subQueue) pushHello(rpc *RPC) {
+	q.lk.Lock()
+	q.hello = rpc.Hello
+	q.lk.Unlock()
+
+	q.push(rpc.Subscriptions)
+	if rpc.Hello != nil {
+		q.wake()
+	}
+}
+
+// pushExchange queues peers to tell about, keeping the latest
+// maxExchangePeers of them
+func (q *subQueue) pushExchange(px []*pb.RPC_PeerExchange) {
+	if len(px) == 0 {
+		return
+	}
+
+	q.lk.Lock()
+	q.exchange = append(q.exchange, px...)
+	if n := len(q.exchange); n > maxExchangePeers {
+		q.exchange = q.exchange[n-maxExchangePeers:]
+	}
+	q.lk.Unlock()
+
+	q.wake()
+}
+
+// push queues subscription changes and wakes up the writer
+func (q *subQueue) push(subs []*pb.RPC_SubOpts) {
+	if len(subs) == 0 {
+		return
+	}
+
+	q.lk.Lock()
+	for _, so := range subs {
+		q.pending[so.GetTopicid()] = so.GetSubscribe()
+	}
+	q.lk.Unlock()
+
+	q.wake()
+}
+
+// wake signals the writer that there is something to send
+func (q *subQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns an RPC announcing all pending changes, or nil if there are none
+func (q *subQueue) pop() *RPC {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if len(q.pending) == 0 && q.hello == nil && len(q.exchange) == 0 {
+		return nil
+	}
+
+	subs := make([]*pb.RPC_SubOpts, 0, len(q.pending))
+	for topic, sub := range q.pending {
+		subs = append(subs, &pb.RPC_SubOpts{
+			Topicid:   proto.String(topic),
+			Subscribe: proto.Bool(sub),
+		})
+	}
+	q.pending = make(map[string]bool)
+
+	rpc := rpcWithSubs(subs...)
+	rpc.Hello = q.hello
+	rpc.Exchange = q.exchange
+	q.hello = nil
+	q.exchange = nil
+	return rpc
+}
+
 func rpcWithSubs(subs ...*pb.RPC_SubOpts) *RPC {
 	return &RPC{
 		RPC: pb.RPC{
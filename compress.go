@@ -0,0 +1,139 @@
+package floodsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// Codec compresses and decompresses the data of messages. Its name goes
+// along with the messages it compressed, so the other side can pick the same
+// codec to decompress them.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress must fail rather than return more than limit bytes
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// GzipCodec compresses data with gzip
+var GzipCodec Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", limit)
+	}
+	return out, nil
+}
+
+// WithCompression compresses the data of messages we publish with c, unless
+// that doesn't make it smaller, and decompresses messages compressed with c
+// before validating and delivering them, so subscribers see the original
+// data. Messages failing to decompress are dropped, and messages compressed
+// with a codec we don't know are relayed but not delivered, like fragments by
+// nodes without fragmentation; both are counted in Stats.DroppedCompression.
+// Nodes relay messages as they arrived, compressed or not, so nodes without
+// the codec don't split the network. It may be given
+// several times to decompress with more codecs; we compress with the last
+// one.
+func WithCompression(c Codec) Option {
+	return func(p *PubSub) error {
+		if c == nil {
+			return fmt.Errorf("codec must not be nil")
+		}
+		if c.Name() == "" {
+			return fmt.Errorf("codec name must not be empty")
+		}
+
+		p.compressor = c
+		p.codecs[c.Name()] = c
+		return nil
+	}
+}
+
+// compress returns data compressed with the codec set with WithCompression
+// along with the name of the codec, or data itself and nil if compression
+// is disabled or wouldn't save anything.
+func (p *PubSub) compress(data []byte) ([]byte, *string, error) {
+	if p.compressor == nil || len(data) == 0 {
+		return data, nil, nil
+	}
+
+	cdata, err := p.compressor.Compress(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compressing message: %s", err)
+	}
+	if len(cdata) >= len(data) {
+		return data, nil, nil
+	}
+	return cdata, proto.String(p.compressor.Name()), nil
+}
+
+// knowsCodec returns whether we can decompress pmsg, which is true if it
+// isn't compressed.
+func (p *PubSub) knowsCodec(pmsg *pb.Message) bool {
+	name := pmsg.GetCompression()
+	if name == "" {
+		return true
+	}
+
+	_, ok := p.codecs[name]
+	return ok
+}
+
+// decompress returns pmsg with its data decompressed if it is compressed, or
+// pmsg itself otherwise. The returned bool is false if the message couldn't
+// be decompressed. The codec of pmsg must be known.
+func (p *PubSub) decompress(pmsg *pb.Message) (*pb.Message, bool) {
+	name := pmsg.GetCompression()
+	if name == "" {
+		return pmsg, true
+	}
+
+	c := p.codecs[name]
+
+	data, err := c.Decompress(pmsg.GetData(), p.maxMessageSize)
+	if err != nil {
+		p.log.Infof("dropping message from %s: decompressing: %s", pmsg.GetFrom(), err)
+		return nil, false
+	}
+
+	dmsg := *pmsg
+	dmsg.Data = data
+	dmsg.Compression = nil
+	return &dmsg, true
+}
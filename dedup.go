@@ -0,0 +1,64 @@
+package floodsub
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	timecache "github.com/whyrusleeping/timecache"
+)
+
+// ContentMsgIdFn is a MsgIdFunction identifying messages by their topics
+// and data instead of their origin and seqno. Used with WithMessageIdFn, it
+// makes identical content published by different peers propagate once.
+func ContentMsgIdFn(pmsg *pb.Message) string {
+	h := sha256.New()
+
+	var l [8]byte
+	for _, t := range pmsg.GetTopicIDs() {
+		binary.BigEndian.PutUint64(l[:], uint64(len(t)))
+		h.Write(l[:])
+		h.Write([]byte(t))
+	}
+	h.Write(pmsg.GetData())
+
+	return string(h.Sum(nil))
+}
+
+// WithContentDedup suppresses messages carrying the same topics and data as
+// a message seen within window, even if their message IDs differ, e.g.
+// because different peers published them. Duplicates are neither delivered
+// nor forwarded, and counted in Stats.DroppedContentDup. The content
+// cache is kept in addition to the seen message cache, so it may use a
+// longer window without affecting regular deduplication.
+func WithContentDedup(window time.Duration) Option {
+	return func(p *PubSub) error {
+		if window <= 0 {
+			return fmt.Errorf("content dedup window must be positive, got %s", window)
+		}
+
+		p.seenContent = timecache.NewTimeCache(window)
+		return nil
+	}
+}
+
+// markContent records the content of dmsg, and returns false if it was seen
+// already. dmsg must be decrypted, as encrypting the same data twice
+// usually gives different ciphertexts.
+// Only called from processLoop.
+func (p *PubSub) markContent(dmsg *pb.Message) bool {
+	if p.seenContent == nil {
+		return true
+	}
+
+	id := ContentMsgIdFn(dmsg)
+	if p.seenContent.Has(id) {
+		return false
+	}
+
+	p.seenContent.Add(id)
+	return true
+}
@@ -0,0 +1,73 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// directPeerRetryInterval is how long we wait before dialing a direct peer
+// again after its stream failed
+const directPeerRetryInterval = time.Second
+
+// deadPeer reports the failure of the session with a peer, identified by
+// its outbound queue. A nil queue reports a peer gone idle, whatever session
+// we have with it.
+type deadPeer struct {
+	pid      peer.ID
+	outgoing <-chan *RPC
+}
+
+// WithDirectPeers makes us always keep a session with the given peers. They
+// are dialed on startup and again whenever their stream fails, and a new
+// stream to them replaces the one we have instead of being dropped as a
+// duplicate.
+func WithDirectPeers(peers []pstore.PeerInfo) Option {
+	return func(p *PubSub) error {
+		for _, pi := range peers {
+			if pi.ID == "" {
+				return fmt.Errorf("direct peer must have an ID")
+			}
+
+			p.directPeers[pi.ID] = pi
+		}
+		return nil
+	}
+}
+
+// connectDirect dials pi after delay and hands a new stream to it to
+// processLoop, retrying until it succeeds or we shut down.
+func (p *PubSub) connectDirect(pi pstore.PeerInfo, delay time.Duration) {
+	for {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-p.done:
+				return
+			}
+		}
+		delay = directPeerRetryInterval
+
+		h := p.Host()
+		err := p.dial(p.ctx, h, pi)
+		if err != nil {
+			p.log.Warningf("connecting to direct peer %s: %s", pi.ID, err)
+			continue
+		}
+
+		s, err := h.NewStream(p.ctx, pi.ID, p.protocols...)
+		if err != nil {
+			p.log.Warningf("opening stream to direct peer %s: %s", pi.ID, err)
+			continue
+		}
+
+		select {
+		case p.newPeers <- s:
+		case <-p.done:
+			s.Close()
+		}
+		return
+	}
+}
@@ -0,0 +1,161 @@
+package floodsub
+
+import (
+	"context"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// TopicEventType tells whether a peer joined or left a topic
+type TopicEventType int
+
+const (
+	// PeerJoin is emitted when a peer announces interest in a topic
+	PeerJoin TopicEventType = iota
+	// PeerLeave is emitted when a peer unsubscribes from a topic or goes away
+	PeerLeave
+)
+
+func (t TopicEventType) String() string {
+	switch t {
+	case PeerJoin:
+		return "PeerJoin"
+	case PeerLeave:
+		return "PeerLeave"
+	default:
+		return "Unknown"
+	}
+}
+
+// TopicEvent describes a change in the topic subscriptions of one of our peers
+type TopicEvent struct {
+	Type  TopicEventType
+	Peer  peer.ID
+	Topic string
+}
+
+// topicEventBufSize is the buffer size of topic event channels. Events that
+// don't fit because the consumer is too slow are dropped.
+const topicEventBufSize = 32
+
+// SubscribeTopicEvents returns a channel of events describing our peers
+// joining and leaving topics. Events are emitted by the event loop in the
+// same order it updates its view of peer subscriptions. Delivery stops and
+// the channel is closed when ctx is cancelled or the PubSub is closed.
+func (p *PubSub) SubscribeTopicEvents(ctx context.Context) (<-chan TopicEvent, error) {
+	ch := make(chan TopicEvent, topicEventBufSize)
+	select {
+	case p.addTopicEvts <- ch:
+	case <-p.done:
+		return nil, p.closedErr()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.done:
+			return
+		}
+
+		select {
+		case p.rmTopicEvts <- ch:
+		case <-p.done:
+		}
+	}()
+
+	return ch, nil
+}
+
+// notifyTopicEvent sends evt to all topic event subscribers without blocking.
+// Only called from processLoop.
+func (p *PubSub) notifyTopicEvent(evt TopicEvent) {
+	for ch := range p.topicEvtSubs {
+		select {
+		case ch <- evt:
+		default:
+			p.log.Infof("dropping topic event for %s: consumer too slow", evt.Topic)
+		}
+	}
+}
+
+// PeerEventType tells whether a pubsub session with a peer started or ended,
+// or what the peer told us when it did
+type PeerEventType int
+
+const (
+	// PeerConnected is emitted when we start exchanging pubsub messages with
+	// a peer
+	PeerConnected PeerEventType = iota
+	// PeerDisconnected is emitted when the pubsub session with a peer ends
+	PeerDisconnected
+	// PeerHello is emitted when a peer sent us the data it set with
+	// WithHelloExtension, carried in Hello. It may arrive before or after
+	// PeerConnected.
+	PeerHello
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "PeerConnected"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	case PeerHello:
+		return "PeerHello"
+	default:
+		return "Unknown"
+	}
+}
+
+// PeerEvent describes a peer starting or ending a pubsub session with us
+type PeerEvent struct {
+	Type PeerEventType
+	Peer peer.ID
+
+	// Hello is the hello extension of the peer for PeerHello events
+	Hello []byte
+}
+
+// peerEventBufSize is the buffer size of peer event channels. Events that
+// don't fit because the consumer is too slow are dropped.
+const peerEventBufSize = 32
+
+// SubscribePeerEvents returns a channel of events describing pubsub sessions
+// with our peers starting and ending. Like topic events they are dropped if
+// the consumer doesn't keep up, and the channel is closed when ctx is
+// cancelled or the PubSub is closed.
+func (p *PubSub) SubscribePeerEvents(ctx context.Context) (<-chan PeerEvent, error) {
+	ch := make(chan PeerEvent, peerEventBufSize)
+	select {
+	case p.addPeerEvts <- ch:
+	case <-p.done:
+		return nil, p.closedErr()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.done:
+			return
+		}
+
+		select {
+		case p.rmPeerEvts <- ch:
+		case <-p.done:
+		}
+	}()
+
+	return ch, nil
+}
+
+// notifyPeerEvent sends evt to all peer event subscribers without blocking.
+// Only called from processLoop.
+func (p *PubSub) notifyPeerEvent(evt PeerEvent) {
+	for ch := range p.peerEvtSubs {
+		select {
+		case ch <- evt:
+		default:
+			p.log.Infof("dropping peer event for %s: consumer too slow", evt.Peer)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package floodsub
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// maxExchangePeers caps the peers we tell a peer about at once, and
+	// the peers we dial for each RPC of a peer telling us about others
+	maxExchangePeers = 16
+
+	// maxExchangeAddrs caps the addresses exchanged for each peer
+	maxExchangeAddrs = 8
+
+	// exchangeDialTimeout is how long we try to connect to a peer we were
+	// told about
+	exchangeDialTimeout = time.Second * 10
+)
+
+// WithPeerExchange(true) enables peer exchange: when a peer joins a topic,
+// we tell it about the other peers we know on the topic and their
+// addresses, and when we join a topic and are told about peers on it, we
+// connect to them. This lets the peers of a topic find each other without
+// relying on the connections made by the application. At most
+// maxExchangePeers peers are exchanged at once; peers without the option
+// neither send nor act on peer exchange.
+func WithPeerExchange(enabled bool) Option {
+	return func(p *PubSub) error {
+		p.peerExchange = enabled
+		return nil
+	}
+}
+
+// sendExchange tells to about the peers we know on topics, which it just
+// joined.
+// Only called from processLoop.
+func (p *PubSub) sendExchange(to peer.ID, topics []string) {
+	q, ok := p.peerSubs[to]
+	if !ok {
+		return
+	}
+
+	ps := p.host.Peerstore()
+	seen := map[peer.ID]struct{}{to: {}}
+	var px []*pb.RPC_PeerExchange
+	for _, t := range topics {
+		for pid := range p.topics[t] {
+			if len(px) == maxExchangePeers {
+				break
+			}
+			if _, ok := seen[pid]; ok {
+				continue
+			}
+			seen[pid] = struct{}{}
+
+			addrs := ps.Addrs(pid)
+			if len(addrs) == 0 {
+				continue
+			}
+			if len(addrs) > maxExchangeAddrs {
+				addrs = addrs[:maxExchangeAddrs]
+			}
+
+			e := &pb.RPC_PeerExchange{Topicid: proto.String(t), PeerID: []byte(pid)}
+			for _, a := range addrs {
+				e.Addrs = append(e.Addrs, a.Bytes())
+			}
+			px = append(px, e)
+		}
+	}
+
+	q.pushExchange(px)
+}
+
+// handleExchange connects to the peers from told us about, on topics we are
+// subscribed to.
+// Only called from processLoop.
+func (p *PubSub) handleExchange(from peer.ID, px []*pb.RPC_PeerExchange) {
+	if len(px) > maxExchangePeers {
+		px = px[:maxExchangePeers]
+	}
+
+	for _, e := range px {
+		if len(p.myTopics[e.GetTopicid()]) == 0 {
+			continue
+		}
+
+		pid, err := peer.IDFromBytes(e.GetPeerID())
+		if err != nil {
+			p.log.Debugf("ignoring exchanged peer from %s: %s", from, err)
+			continue
+		}
+		if _, ok := p.peers[pid]; ok || pid == p.host.ID() {
+			continue
+		}
+		if _, ok := p.blacklist[pid]; ok {
+			continue
+		}
+
+		raw := e.GetAddrs()
+		if len(raw) > maxExchangeAddrs {
+			raw = raw[:maxExchangeAddrs]
+		}
+		var addrs []ma.Multiaddr
+		for _, b := range raw {
+			a, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				p.log.Debugf("ignoring address of exchanged peer %s: %s", pid, err)
+				continue
+			}
+			addrs = append(addrs, a)
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+
+		go p.connectExchanged(pstore.PeerInfo{ID: pid, Addrs: addrs})
+	}
+}
+
+// connectExchanged connects to a peer we were told about. The session is
+// set up once we are connected, as for any other peer.
+func (p *PubSub) connectExchanged(pi pstore.PeerInfo) {
+	ctx, cancel := context.WithTimeout(p.ctx, exchangeDialTimeout)
+	defer cancel()
+
+	if err := p.dial(ctx, p.Host(), pi); err != nil {
+		p.log.Debugf("connecting to exchanged peer %s: %s", pi.ID, err)
+	}
+}
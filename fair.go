@@ -0,0 +1,155 @@
+package floodsub
+
+import (
+	"fmt"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// fairQueue buffers the RPCs read from each peer separately, and hands them
+// to the event loop taking turns between the peers
+type fairQueue struct {
+	// size is the number of RPCs buffered per stream
+	size int
+
+	lk      sync.Mutex
+	pending map[peer.ID][]queuedRPC
+
+	// order holds the peers with pending RPCs, the one whose turn it is
+	// first
+	order []peer.ID
+
+	// ready is signalled when RPCs are pushed
+	ready chan struct{}
+}
+
+// queuedRPC is an RPC waiting in a fairQueue along with the slot it takes
+// in the buffer of its stream
+type queuedRPC struct {
+	rpc  *RPC
+	slot chan struct{}
+}
+
+// WithFairIncoming buffers up to n RPCs read from each peer stream on its
+// own, and passes them on to the event loop taking turns between the peers,
+// so a peer sending a lot can't crowd out the others: once its buffer is
+// full, reads from it block while the other peers still get through. The
+// queue set with WithIncomingQueueSize still sits between the buffers and
+// the event loop. IncomingQueueDepths reports how full the buffers are.
+func WithFairIncoming(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("per peer incoming queue size must be positive, got %d", n)
+		}
+
+		p.fair = &fairQueue{
+			size:    n,
+			pending: make(map[peer.ID][]queuedRPC),
+			ready:   make(chan struct{}, 1),
+		}
+		return nil
+	}
+}
+
+// IncomingQueueDepths returns the number of RPCs of each peer waiting to be
+// handled, or nil unless WithFairIncoming is used. Peers with nothing
+// waiting are left out.
+func (p *PubSub) IncomingQueueDepths() map[peer.ID]int {
+	q := p.fair
+	if q == nil {
+		return nil
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	depths := make(map[peer.ID]int, len(q.pending))
+	for pid, rpcs := range q.pending {
+		depths[pid] = len(rpcs)
+	}
+	return depths
+}
+
+// pushIncoming hands rpc, read from a stream whose buffer is slots, to the
+// event loop. It returns false if we shut down first.
+func (p *PubSub) pushIncoming(rpc *RPC, slots chan struct{}) bool {
+	q := p.fair
+	if q == nil {
+		select {
+		case p.incoming <- rpc:
+			return true
+		case <-p.done:
+			return false
+		}
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-p.done:
+		return false
+	}
+
+	q.lk.Lock()
+	if len(q.pending[rpc.from]) == 0 {
+		q.order = append(q.order, rpc.from)
+	}
+	q.pending[rpc.from] = append(q.pending[rpc.from], queuedRPC{rpc: rpc, slot: slots})
+	q.lk.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop returns the next RPC of the peer whose turn it is, or nil if none are
+// pending.
+func (q *fairQueue) pop() *RPC {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	pid := q.order[0]
+	q.order = q.order[1:]
+
+	rpcs := q.pending[pid]
+	next := rpcs[0]
+	if len(rpcs) > 1 {
+		q.pending[pid] = rpcs[1:]
+		q.order = append(q.order, pid)
+	} else {
+		delete(q.pending, pid)
+	}
+
+	// make room for the stream's reader
+	<-next.slot
+	return next.rpc
+}
+
+// dispatchIncoming passes the RPCs of the fair queue on to the event loop
+// until we shut down.
+func (p *PubSub) dispatchIncoming() {
+	q := p.fair
+	for {
+		rpc := q.pop()
+		if rpc == nil {
+			select {
+			case <-q.ready:
+				continue
+			case <-p.done:
+				return
+			}
+		}
+
+		select {
+		case p.incoming <- rpc:
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -3,31 +3,107 @@ package floodsub
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/libp2p/go-floodsub/pb"
 
+	proto "github.com/gogo/protobuf/proto"
 	logging "github.com/ipfs/go-log"
 	host "github.com/libp2p/go-libp2p-host"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
 	protocol "github.com/libp2p/go-libp2p-protocol"
 	timecache "github.com/whyrusleeping/timecache"
 )
 
+// ID is the default protocol ID of floodsub
 const ID = protocol.ID("/floodsub/1.0.0")
 
+// peerOutboundQueueSize is the number of RPCs buffered for each peer. The
+// queue is only ever written by processLoop, which keeps messages to a peer
+// in order; messages that don't fit are dropped instead of blocking the loop.
+const peerOutboundQueueSize = 32
+
+// DefaultIncomingQueueSize is the number of RPCs read from our peers which
+// are buffered for the event loop by default
+const DefaultIncomingQueueSize = 32
+
+// DefaultMaxMessageSize is the default limit on the size of RPCs we read
+// from and write to peers
+const DefaultMaxMessageSize = 1 << 20
+
+// DefaultSeqnoLength is the length in bytes of the seqnos we pick, and of
+// the seqnos we accept from peers by default
+const DefaultSeqnoLength = 8
+
+// DefaultPeerDrainTimeout is how long we keep sending the messages queued to
+// a peer after dropping it, unless configured otherwise with
+// WithPeerDrainTimeout
+const DefaultPeerDrainTimeout = time.Second
+
+// DefaultMessageCacheDuration is how long seen message IDs are remembered
+// unless configured otherwise with WithMessageCacheDuration
+const DefaultMessageCacheDuration = time.Second * 30
+
+// MaxTopicLength is the length in bytes of the longest topic a message may
+// carry. Messages with longer topics are dropped.
+const MaxTopicLength = 1024
+
 var log = logging.Logger("floodsub")
 
+// ErrPubSubClosed is returned by operations on a PubSub that has been closed
+var ErrPubSubClosed = errors.New("pubsub closed")
+
+// ErrNotSubscribed is returned by Unsubscribe for topics we aren't
+// subscribed to
+var ErrNotSubscribed = errors.New("not subscribed to topic")
+
+// ErrAuthUnsupported is returned when subscribing with a TopicDescriptor
+// asking for authentication, which isn't implemented
+var ErrAuthUnsupported = errors.New("auth mode not yet supported")
+
+// ErrEncUnsupported is returned when subscribing with a TopicDescriptor
+// asking for encryption, which isn't implemented
+var ErrEncUnsupported = errors.New("encryption mode not yet supported")
+
 type PubSub struct {
-	host host.Host
+	// stats is accessed atomically and must stay the first field to keep
+	// its counters 64-bit aligned on 32-bit platforms
+	stats Stats
+
+	// counter is the last seqno used for a message we published. It is
+	// accessed atomically and must stay 64-bit aligned, behind stats.
+	counter uint64
+
+	// peerCount mirrors len(peers) for readers outside of processLoop. It is
+	// accessed atomically.
+	peerCount int32
+
+	// host is only written by processLoop, under hostLk. Other goroutines
+	// read it through Host.
+	hostLk sync.RWMutex
+	host   host.Host
+
+	// protocols are the protocol IDs we speak floodsub on, in order of
+	// preference
+	protocols []protocol.ID
 
 	// incoming messages from other peers
 	incoming chan *RPC
 
+	// incomingSize is the buffer size of incoming
+	incomingSize int
+
+	// fair, if not nil, buffers the RPCs of each peer before incoming
+	fair *fairQueue
+
 	// messages we are publishing out to our peers
-	publish chan *Message
+	publish chan *publishReq
 
 	// addSub is a control channel for us to add and remove subscriptions
 	addSub chan *addSubReq
@@ -35,32 +111,292 @@ type PubSub struct {
 	// get list of topics we are subscribed to
 	getTopics chan *topicReq
 
+	// get list of topics our peers are subscribed to
+	getPeersTopics chan *topicReq
+
+	// check whether we are subscribed to a topic
+	isSubscribed chan *isSubscribedReq
+
+	// count the peers subscribed to a topic
+	topicPeerCount chan *topicPeerCountReq
+
+	// query or flush the seen message cache
+	seenCacheCh chan *seenCacheReq
+
 	// get chan of peers we are connected to
 	getPeers chan *listPeerReq
 
+	// get list of topics a peer is subscribed to
+	getPeerTopics chan *peerTopicsReq
+
+	// get the score of a peer
+	getPeerScore chan *peerScoreReq
+
+	// get the last seqno of an origin
+	getLastSeqno chan *lastSeqnoReq
+
+	// get the connection details of a peer
+	getPeerInfo chan *peerInfoReq
+
+	// get a snapshot of our state
+	getSnapshot chan *snapshotReq
+
+	// count our Subscriptions to each topic
+	getSubCounts chan *subCountsReq
+
+	// move us to another host
+	setHost chan *setHostReq
+
 	// send subscription here to cancel it
 	cancelCh chan *Subscription
 
+	// send a closed Topic here to cancel its subscriptions
+	leave chan *Topic
+
+	// unsubTopic is a control channel to cancel all subscriptions of a topic
+	unsubTopic chan *unsubReq
+
+	// blacklistCh is a control channel to add and remove blacklisted peers
+	blacklistCh chan *blacklistReq
+
+	// addTopicEvts and rmTopicEvts add and remove topic event subscribers
+	addTopicEvts chan chan TopicEvent
+	rmTopicEvts  chan chan TopicEvent
+
+	// addPeerEvts and rmPeerEvts add and remove peer event subscribers
+	addPeerEvts chan chan PeerEvent
+	rmPeerEvts  chan chan PeerEvent
+
+	// addVal and rmVal are control channels to add and remove topic validators
+	addVal chan *addValReq
+	rmVal  chan *rmValReq
+
 	// a notification channel for incoming streams from other peers
 	newPeers chan inet.Stream
 
 	// a notification channel for when our peers die
-	peerDead chan peer.ID
+	peerDead chan deadPeer
+
+	// directPeers holds the peers we always keep a session with. It is only
+	// written by options.
+	directPeers map[peer.ID]pstore.PeerInfo
 
 	// The set of topics we are subscribed to
 	myTopics map[string]map[*Subscription]struct{}
 
+	// myPrefixes holds the prefixes of the wildcard topics in myTopics
+	myPrefixes map[string]struct{}
+
+	// allSubs holds the Subscriptions made with SubscribeAll
+	allSubs map[*Subscription]struct{}
+
 	// topics tracks which topics each of our peers are subscribed to
 	topics map[string]map[peer.ID]struct{}
 
+	// peerPrefixes holds the prefixes of wildcard topics our peers have
+	// subscribed to, so we don't need to scan topics for them
+	peerPrefixes map[string]struct{}
+
+	// blacklist is the set of peers whose RPCs we ignore
+	blacklist map[peer.ID]struct{}
+
+	// topicEvtSubs is the set of channels receiving topic events
+	topicEvtSubs map[chan TopicEvent]struct{}
+
+	// peerEvtSubs is the set of channels receiving peer events
+	peerEvtSubs map[chan PeerEvent]struct{}
+
+	// pendingAnnounce holds the subscription changes not announced yet.
+	// announceFlush fires when they are due and is nil while none are
+	// pending.
+	pendingAnnounce map[string]bool
+	announceFlush   <-chan time.Time
+	announceDelay   time.Duration
+
+	// refresh fires every refreshInterval to announce all our
+	// subscriptions again, and is nil if refreshing is disabled
+	refresh         <-chan time.Time
+	refreshInterval time.Duration
+
+	// streams holds all streams we read from or write to, so that shutdown
+	// can close them and unblock their readers and writers. It is nil once
+	// they have been closed.
+	streamsLk sync.Mutex
+	streams   map[inet.Stream]struct{}
+
+	// replay holds the messages kept for WithReplay by topic
+	replay map[string]*replayBuffer
+
+	// joined holds the handles of the topics joined with Join
+	joinedLk sync.Mutex
+	joined   map[string]*Topic
+
+	// topicVals holds the validator registered for each topic
+	topicVals map[string]Validator
+
 	peers        map[peer.ID]chan *RPC
-	seenMessages *timecache.TimeCache
+	seenMessages SeenCache
+
+	// newSeenCache creates the empty cache FlushSeenCache replaces
+	// seenMessages with. It is nil if seenMessages was set with
+	// WithSeenCache.
+	newSeenCache func() SeenCache
+
+	// seenContent, if not nil, holds the content IDs of recent messages
+	seenContent *timecache.TimeCache
+
+	// peerSubs holds the subscription changes to announce to each peer
+	peerSubs map[peer.ID]*subQueue
+
+	// peerStreams holds our outbound stream to each peer
+	peerStreams map[peer.ID]inet.Stream
+
+	// topicCiphers holds the cipher of each encrypted topic. It is only
+	// written by options, so it may be read from any goroutine.
+	topicCiphers map[string]TopicCipher
+
+	// compressor compresses the data of messages we publish, if not nil.
+	// codecs holds the codecs we decompress messages with by name. Both are
+	// only written by options.
+	compressor Codec
+	codecs     map[string]Codec
+
+	// peerTopicCount holds the number of topics each peer is subscribed to,
+	// and maxTopicsPerPeer, if positive, caps it
+	peerTopicCount   map[peer.ID]int
+	maxTopicsPerPeer int
+
+	// limiters holds the message budget of each peer when rate limiting
+	limiters  map[peer.ID]*tokenBucket
+	rateLimit rateLimit
+
+	// scores holds the message counters of each peer
+	scores map[peer.ID]*PeerScore
+
+	// lastSeqnos holds the highest seqno received from each origin
+	lastSeqnos map[peer.ID]uint64
+
+	// peerInfos holds the connection details of each peer
+	peerInfos map[peer.ID]PeerInfo
+
+	// dialed holds the peers we are dialing or dialed ourselves, until
+	// we set up a session with them or disconnect
+	dialLk sync.Mutex
+	dialed map[peer.ID]struct{}
+
+	// fragments holds the fragmentation settings and the fragments of
+	// incomplete messages
+	fragments fragmentation
+
+	// ordering holds the settings and state of ordered delivery
+	ordering ordering
+
+	// shards holds the workers validating messages of peers
+	shards workerShards
+
+	// observer passes every valid message to the function set with
+	// WithMessageObserver
+	observer messageObserver
+
+	// pubLimits holds the limits on publishing to topics
+	pubLimits publishLimits
+
+	// shedding configures dropping messages while we fall behind
+	shedding loadShedding
+
+	// forwardPolicy, if not nil, picks the peers we send a message to
+	forwardPolicy ForwardPolicy
+
+	// leaf is set if we don't relay messages of our peers
+	leaf bool
+
+	// noLoopback is set if our own messages aren't delivered to our
+	// subscriptions
+	noLoopback bool
+
+	// maxDegree, if positive, is the number of peers we send a message to
+	// at most
+	maxDegree int
+
+	// publishAsHost is set if PublishAs may use our own ID
+	publishAsHost bool
+
+	// sendSlots, if not nil, holds a token for every write to a peer in
+	// flight
+	sendSlots chan struct{}
+
+	// idleTimeout, if positive, is how long we wait for an RPC from a
+	// peer before dropping it
+	idleTimeout time.Duration
+
+	// reconnect configures reopening failed streams to peers we are
+	// still connected to
+	reconnect reconnectPolicy
+
+	// slowPeers configures what happens when the queue of a peer is full
+	slowPeers slowPeerPolicy
+
+	// drainTimeout is how long the writer of a peer we drop gets to
+	// send the messages still queued to it
+	drainTimeout time.Duration
+
+	// seenMessagesTTL is how long message IDs stay in seenMessages
+	seenMessagesTTL time.Duration
+
+	// metrics holds the prometheus collectors, nil if metrics are disabled
+	metrics *metrics
+
+	// msgID computes the ID under which messages are deduplicated
+	msgID MsgIdFunction
+
+	// maxMessageSize is the largest RPC we accept from or send to peers
+	maxMessageSize int
+
+	// seqnoLen is the seqno length we accept from peers, 0 for any
+	seqnoLen int
+
+	// topicCheck, if not nil, is the check set with WithTopicValidator
+	topicCheck func(string) error
+
+	// log is where we log to. It is only written by options.
+	log Logger
+
+	// relayTopics holds the topics set with WithRelayTopics. It is only
+	// written by options.
+	relayTopics map[string]struct{}
+
+	// helloExt is sent to new peers with our subscriptions, if not nil
+	helloExt []byte
+
+	// peerExchange is set by WithPeerExchange
+	peerExchange bool
+
+	// closing is closed by Close to tell processLoop to shut down
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// done is closed once processLoop has exited and released all state
+	done chan struct{}
+
+	// writers tracks the running handleSendingMessages goroutines
+	writers sync.WaitGroup
 
 	ctx context.Context
 }
 
 type Message struct {
 	*pb.Message
+
+	// MatchedTopic is the topic of the message which matched the
+	// Subscription it was delivered to. For a prefix subscription it is the
+	// first topic of the message starting with the prefix. It is only set on
+	// messages delivered to subscriptions.
+	MatchedTopic string
+
+	// ReceivedAt is the local time we first saw the message, which for our
+	// own messages is when we published them. It is never sent to peers and
+	// only set on messages delivered to subscriptions and observers.
+	ReceivedAt time.Time
 }
 
 func (m *Message) GetFrom() peer.ID {
@@ -74,60 +410,541 @@ type RPC struct {
 	from peer.ID
 }
 
-// NewFloodSub returns a new FloodSub management object
-func NewFloodSub(ctx context.Context, h host.Host) *PubSub {
+// Option is a functional option configuring a PubSub on construction.
+// Options may reject invalid settings by returning an error, which is then
+// returned from NewFloodSub.
+type Option func(*PubSub) error
+
+// WithMessageCacheDuration sets how long the IDs of seen messages are kept
+// to suppress duplicates. The memory used by the cache is proportional to
+// the message rate times this duration. Defaults to
+// DefaultMessageCacheDuration.
+func WithMessageCacheDuration(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d <= 0 {
+			return fmt.Errorf("message cache duration must be positive, got %s", d)
+		}
+
+		p.seenMessagesTTL = d
+		return nil
+	}
+}
+
+// WithMessageIdFn sets the function computing the ID of a message for
+// deduplication, e.g. to identify messages by their content rather than by
+// origin and seqno. All nodes of a network should use the same function, or
+// messages may loop between nodes disagreeing on their IDs.
+func WithMessageIdFn(fn MsgIdFunction) Option {
+	return func(p *PubSub) error {
+		if fn == nil {
+			return fmt.Errorf("message ID function must not be nil")
+		}
+
+		p.msgID = fn
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the largest RPC, in bytes, we accept from our
+// peers. Streams sending larger RPCs are closed. Publishing a message that
+// would exceed the limit fails. Defaults to DefaultMaxMessageSize.
+func WithMaxMessageSize(n int) Option {
+	return func(p *PubSub) error {
+		if n <= 0 {
+			return fmt.Errorf("max message size must be positive, got %d", n)
+		}
+
+		p.maxMessageSize = n
+		return nil
+	}
+}
+
+// WithSeqnoLength makes us drop messages from peers whose seqno isn't n
+// bytes long, counting them in Stats.DroppedMalformed. A length of 0
+// accepts any seqno, e.g. to relay messages of implementations picking
+// seqnos differently. Defaults to DefaultSeqnoLength.
+func WithSeqnoLength(n int) Option {
+	return func(p *PubSub) error {
+		if n < 0 {
+			return fmt.Errorf("seqno length must not be negative, got %d", n)
+		}
+
+		p.seqnoLen = n
+		return nil
+	}
+}
+
+// WithTopicValidator makes us reject topics for which fn returns an error,
+// on top of empty topics and those longer than MaxTopicLength, which are
+// always rejected. It applies to the topics we subscribe to and publish on,
+// where the error is returned, and to those of the messages and
+// subscriptions of our peers, which are dropped. fn is called from several
+// goroutines at once, and from the event loop for the topics of our peers,
+// so it must be fast.
+func WithTopicValidator(fn func(string) error) Option {
+	return func(p *PubSub) error {
+		if fn == nil {
+			return fmt.Errorf("topic validator must not be nil")
+		}
+
+		p.topicCheck = fn
+		return nil
+	}
+}
+
+// WithLocalLoopback(false) stops delivering the messages we publish to our
+// own subscriptions; they are only sent to our peers. This suits publishers
+// which already have the data they broadcast. Messages published by us for
+// other authors, with PublishAs or PublishRaw, are not delivered either.
+// Loopback is enabled by default.
+func WithLocalLoopback(enabled bool) Option {
+	return func(p *PubSub) error {
+		p.noLoopback = !enabled
+		return nil
+	}
+}
+
+// WithHelloExtension sends ext to every new peer along with our
+// subscriptions, e.g. to tell them about the role or version of the node.
+// Peers with the PubSub subscribed to peer events get it in a PeerHello
+// event; other floodsub implementations ignore it.
+func WithHelloExtension(ext []byte) Option {
+	return func(p *PubSub) error {
+		if len(ext) == 0 {
+			return fmt.Errorf("hello extension must not be empty")
+		}
+
+		p.helloExt = append([]byte(nil), ext...)
+		return nil
+	}
+}
+
+// WithPeerDrainTimeout sets how long the messages still queued to a peer
+// are sent after we drop it, e.g. because it was blacklisted or a write
+// to it failed. Messages not sent in time are counted in
+// Stats.DroppedPeerGone. A timeout of 0 drops them right away. Defaults to
+// DefaultPeerDrainTimeout.
+func WithPeerDrainTimeout(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d < 0 {
+			return fmt.Errorf("peer drain timeout must not be negative, got %s", d)
+		}
+
+		p.drainTimeout = d
+		return nil
+	}
+}
+
+// WithStreamIdleTimeout drops peers which don't send us an RPC within d,
+// closing their stream and ours. Any RPC, e.g. the subscription refresh of
+// WithSubscriptionRefreshInterval, keeps a peer connected. Direct peers are
+// never dropped for being idle. A timeout of 0, the default, keeps idle
+// peers.
+func WithStreamIdleTimeout(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d < 0 {
+			return fmt.Errorf("stream idle timeout must not be negative, got %s", d)
+		}
+
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// WithIncomingQueueSize sets the number of RPCs read from our peers which are
+// buffered until the event loop gets to them. Once the buffer is full, reads
+// from our peers block. Relays with many peers may want a larger buffer to
+// absorb bursts, memory constrained nodes a smaller one. Defaults to
+// DefaultIncomingQueueSize.
+func WithIncomingQueueSize(n int) Option {
+	return func(p *PubSub) error {
+		if n < 0 {
+			return fmt.Errorf("incoming queue size must not be negative, got %d", n)
+		}
+
+		p.incomingSize = n
+		return nil
+	}
+}
+
+// WithMaxTopicsPerPeer caps the number of topics we track for each peer.
+// Subscriptions of a peer beyond the cap are ignored, so we don't forward the
+// corresponding messages, and counted in Stats.RejectedSubscriptions. This
+// bounds the memory a peer can make us spend on its announcements.
+func WithMaxTopicsPerPeer(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("max topics per peer must be positive, got %d", n)
+		}
+
+		p.maxTopicsPerPeer = n
+		return nil
+	}
+}
+
+// WithAnnounceBatching makes us collect the subscription changes made within
+// d of the first one and announce them to our peers in a single RPC, instead
+// of sending one RPC per change. This saves many small RPCs when subscribing
+// to lots of topics at once, at the cost of peers learning about each change
+// up to d later. By default changes are announced right away.
+func WithAnnounceBatching(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d < 0 {
+			return fmt.Errorf("announce batching delay must not be negative, got %s", d)
+		}
+
+		p.announceDelay = d
+		return nil
+	}
+}
+
+// WithSubscriptionRefreshInterval makes us announce all our subscriptions to
+// our peers again every d, in a single RPC per peer. This repairs the view
+// of peers which missed an announcement, at the cost of some bandwidth. By
+// default subscriptions are only announced when they change.
+func WithSubscriptionRefreshInterval(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d <= 0 {
+			return fmt.Errorf("subscription refresh interval must be positive, got %s", d)
+		}
+
+		p.refreshInterval = d
+		return nil
+	}
+}
+
+// WithProtocolID sets the protocol ID floodsub uses for its streams, to
+// build an overlay isolated from floodsub nodes of other applications
+// sharing the same hosts. Defaults to ID.
+func WithProtocolID(pid protocol.ID) Option {
+	return WithProtocolIDs(pid)
+}
+
+// WithProtocolIDs sets several protocol IDs floodsub accepts streams on,
+// e.g. to migrate a network to a new protocol version. When opening streams
+// to peers, the first of the IDs the remote supports is used, so they should
+// be given in order of preference.
+func WithProtocolIDs(pids ...protocol.ID) Option {
+	return func(p *PubSub) error {
+		if len(pids) == 0 {
+			return fmt.Errorf("at least one protocol ID is required")
+		}
+
+		for _, pid := range pids {
+			if pid == "" {
+				return fmt.Errorf("protocol ID must not be empty")
+			}
+		}
+
+		p.protocols = append([]protocol.ID(nil), pids...)
+		return nil
+	}
+}
+
+// NewFloodSub returns a new FloodSub management object, configured by the
+// given options. Without options all settings take their default values.
+func NewFloodSub(ctx context.Context, h host.Host, opts ...Option) (*PubSub, error) {
 	ps := &PubSub{
-		host:         h,
-		ctx:          ctx,
-		incoming:     make(chan *RPC, 32),
-		publish:      make(chan *Message),
-		newPeers:     make(chan inet.Stream),
-		peerDead:     make(chan peer.ID),
-		cancelCh:     make(chan *Subscription),
-		getPeers:     make(chan *listPeerReq),
-		addSub:       make(chan *addSubReq),
-		getTopics:    make(chan *topicReq),
-		myTopics:     make(map[string]map[*Subscription]struct{}),
-		topics:       make(map[string]map[peer.ID]struct{}),
-		peers:        make(map[peer.ID]chan *RPC),
-		seenMessages: timecache.NewTimeCache(time.Second * 30),
-	}
-
-	h.SetStreamHandler(ID, ps.handleNewStream)
+		host:            h,
+		protocols:       []protocol.ID{ID},
+		ctx:             ctx,
+		incomingSize:    DefaultIncomingQueueSize,
+		publish:         make(chan *publishReq),
+		newPeers:        make(chan inet.Stream),
+		peerDead:        make(chan deadPeer),
+		cancelCh:        make(chan *Subscription),
+		leave:           make(chan *Topic),
+		joined:          make(map[string]*Topic),
+		replay:          make(map[string]*replayBuffer),
+		unsubTopic:      make(chan *unsubReq),
+		getPeers:        make(chan *listPeerReq),
+		getPeerTopics:   make(chan *peerTopicsReq),
+		getPeerScore:    make(chan *peerScoreReq),
+		getLastSeqno:    make(chan *lastSeqnoReq),
+		getPeerInfo:     make(chan *peerInfoReq),
+		getSnapshot:     make(chan *snapshotReq),
+		getSubCounts:    make(chan *subCountsReq),
+		setHost:         make(chan *setHostReq),
+		addSub:          make(chan *addSubReq),
+		getTopics:       make(chan *topicReq),
+		getPeersTopics:  make(chan *topicReq),
+		isSubscribed:    make(chan *isSubscribedReq),
+		topicPeerCount:  make(chan *topicPeerCountReq),
+		seenCacheCh:     make(chan *seenCacheReq),
+		blacklistCh:     make(chan *blacklistReq),
+		addTopicEvts:    make(chan chan TopicEvent),
+		rmTopicEvts:     make(chan chan TopicEvent),
+		addPeerEvts:     make(chan chan PeerEvent),
+		rmPeerEvts:      make(chan chan PeerEvent),
+		addVal:          make(chan *addValReq),
+		rmVal:           make(chan *rmValReq),
+		myTopics:        make(map[string]map[*Subscription]struct{}),
+		myPrefixes:      make(map[string]struct{}),
+		allSubs:         make(map[*Subscription]struct{}),
+		topics:          make(map[string]map[peer.ID]struct{}),
+		peerPrefixes:    make(map[string]struct{}),
+		blacklist:       make(map[peer.ID]struct{}),
+		topicEvtSubs:    make(map[chan TopicEvent]struct{}),
+		peerEvtSubs:     make(map[chan PeerEvent]struct{}),
+		pendingAnnounce: make(map[string]bool),
+		streams:         make(map[inet.Stream]struct{}),
+		topicVals:       make(map[string]Validator),
+		peers:           make(map[peer.ID]chan *RPC),
+		peerSubs:        make(map[peer.ID]*subQueue),
+		peerStreams:     make(map[peer.ID]inet.Stream),
+		limiters:        make(map[peer.ID]*tokenBucket),
+		scores:          make(map[peer.ID]*PeerScore),
+		lastSeqnos:      make(map[peer.ID]uint64),
+		peerInfos:       make(map[peer.ID]PeerInfo),
+		dialed:          make(map[peer.ID]struct{}),
+		peerTopicCount:  make(map[peer.ID]int),
+		topicCiphers:    make(map[string]TopicCipher),
+		codecs:          make(map[string]Codec),
+		relayTopics:     make(map[string]struct{}),
+		directPeers:     make(map[peer.ID]pstore.PeerInfo),
+		drainTimeout:    DefaultPeerDrainTimeout,
+		fragments:       fragmentation{timeout: DefaultFragmentTimeout, groups: make(map[string]*fragmentGroup), origins: make(map[string]int)},
+		ordering:        ordering{origins: make(map[peer.ID]*originQueue)},
+		pubLimits:       publishLimits{limits: make(map[string]publishRate), buckets: make(map[string]*tokenBucket)},
+		shedding:        loadShedding{priorities: make(map[string]TopicPriority)},
+		reconnect:       reconnectPolicy{attempts: DefaultReconnectAttempts, backoff: DefaultReconnectBackoff},
+		slowPeers:       slowPeerPolicy{timeout: DefaultSlowPeerTimeout},
+		counter:         uint64(time.Now().UnixNano()),
+		seenMessagesTTL: DefaultMessageCacheDuration,
+		msgID:           DefaultMsgIdFn,
+		maxMessageSize:  DefaultMaxMessageSize,
+		seqnoLen:        DefaultSeqnoLength,
+		log:             log,
+		closing:         make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		err := opt(ps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ps.shedding.high > ps.incomingSize {
+		return nil, fmt.Errorf("load shedding high-water mark %d exceeds the incoming queue size %d", ps.shedding.high, ps.incomingSize)
+	}
+
+	if ps.seenMessages == nil {
+		ttl := ps.seenMessagesTTL
+		ps.newSeenCache = func() SeenCache {
+			return timecache.NewTimeCache(ttl)
+		}
+		ps.seenMessages = ps.newSeenCache()
+	}
+	ps.incoming = make(chan *RPC, ps.incomingSize)
+	ps.metrics.setIncomingCapacity(ps.incomingSize)
+	if ps.refreshInterval > 0 {
+		ps.refresh = time.After(ps.refreshInterval)
+	}
+
+	for _, pid := range ps.protocols {
+		h.SetStreamHandler(pid, ps.handleNewStream)
+	}
 	h.Network().Notify((*PubSubNotif)(ps))
 
+	ps.startObserver()
+	ps.startShards()
+	if ps.fair != nil {
+		go ps.dispatchIncoming()
+	}
 	go ps.processLoop(ctx)
 
-	return ps
+	for _, pi := range ps.directPeers {
+		go ps.connectDirect(pi, 0)
+	}
+
+	return ps, nil
+}
+
+// Close shuts down the PubSub: it detaches from the host, closes the streams
+// to and from all peers and cancels all subscriptions. Close blocks until the
+// event loop and all peer writers have exited. It is safe to call Close
+// multiple times.
+func (p *PubSub) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	<-p.done
+	p.writers.Wait()
+	return nil
+}
+
+// Host returns the host the PubSub runs on
+func (p *PubSub) Host() host.Host {
+	p.hostLk.RLock()
+	defer p.hostLk.RUnlock()
+
+	return p.host
+}
+
+type setHostReq struct {
+	host host.Host
+	resp chan error
+}
+
+// SetHost moves the PubSub to host h. It detaches from the current host,
+// drops the sessions with all peers and attaches to h, opening sessions with
+// the peers h is connected to. Subscriptions, validators and the seen
+// message cache are kept, and our subscriptions are announced to the new
+// peers. Messages we publish from then on carry the ID of h as their
+// author.
+func (p *PubSub) SetHost(h host.Host) error {
+	if h == nil {
+		return fmt.Errorf("host must not be nil")
+	}
+
+	out := make(chan error, 1)
+	select {
+	case p.setHost <- &setHostReq{host: h, resp: out}:
+	case <-p.done:
+		return p.closedErr()
+	}
+
+	return <-out
+}
+
+// handleSetHost moves us to the host of req.
+// Only called from processLoop.
+func (p *PubSub) handleSetHost(req *setHostReq) {
+	old := p.host
+	if req.host == old {
+		req.resp <- nil
+		return
+	}
+
+	for _, pid := range p.protocols {
+		old.RemoveStreamHandler(pid)
+	}
+	old.Network().StopNotify((*PubSubNotif)(p))
+
+	for pid := range p.peers {
+		p.handleDeadPeer(pid)
+	}
+	// also stops the readers of the streams peers opened to us
+	p.resetStreams()
+
+	p.hostLk.Lock()
+	p.host = req.host
+	p.hostLk.Unlock()
+
+	for _, pid := range p.protocols {
+		req.host.SetStreamHandler(pid, p.handleNewStream)
+	}
+	req.host.Network().Notify((*PubSubNotif)(p))
+
+	for _, pid := range req.host.Network().Peers() {
+		go p.openStream(pid)
+	}
+	for _, pi := range p.directPeers {
+		go p.connectDirect(pi, 0)
+	}
+
+	req.resp <- nil
+}
+
+// closedErr returns the reason processLoop is gone: the error of the
+// context the PubSub was created with if it has been cancelled, or
+// ErrPubSubClosed if Close has been called.
+func (p *PubSub) closedErr() error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	return ErrPubSubClosed
 }
 
 // processLoop handles all inputs arriving on the channels
 func (p *PubSub) processLoop(ctx context.Context) {
+	defer p.shutdown()
+
 	for {
 		select {
 		case s := <-p.newPeers:
 			pid := s.Conn().RemotePeer()
-			ch, ok := p.peers[pid]
-			if ok {
-				log.Error("already have connection to peer: ", pid)
-				close(ch)
+			if s.Conn().LocalPeer() != p.host.ID() {
+				// opened on the host we were moved away from
+				s.Close()
+				continue
+			}
+			if _, ok := p.blacklist[pid]; ok {
+				p.log.Debugf("ignoring stream to blacklisted peer %s", pid)
+				s.Close()
+				continue
 			}
 
-			messages := make(chan *RPC, 32)
-			go p.handleSendingMessages(ctx, s, messages)
-			messages <- p.getHelloPacket()
+			_, replace := p.peers[pid]
+			if _, direct := p.directPeers[pid]; replace && !direct {
+				// we usually get here when both sides dialed each other.
+				// Keep the session we have instead of tearing down its
+				// queue.
+				p.log.Debugf("already have a stream to peer %s, closing the new one", pid)
+				s.Close()
+				continue
+			}
+			prev := p.peerInfos[pid]
+			if replace {
+				// the session with a direct peer may be broken without us
+				// noticing yet, so the newest stream wins
+				p.log.Debugf("replacing stream to direct peer %s", pid)
+				p.closeSession(pid)
+			}
+
+			p.trackStream(s)
+			messages := make(chan *RPC, peerOutboundQueueSize)
+			subs := newSubQueue()
+			subs.pushHello(p.getHelloPacket())
+			p.writers.Add(1)
+			go p.handleSendingMessages(ctx, s, messages, subs)
 
 			p.peers[pid] = messages
+			p.peerSubs[pid] = subs
+			p.peerStreams[pid] = s
+			p.peerInfos[pid] = p.newPeerInfo(s, prev)
+			atomic.StoreInt32(&p.peerCount, int32(len(p.peers)))
+			p.metrics.setPeers(len(p.peers))
+			if !replace {
+				p.notifyPeerEvent(PeerEvent{Type: PeerConnected, Peer: pid})
+			}
 
-		case pid := <-p.peerDead:
-			ch, ok := p.peers[pid]
-			if ok {
-				close(ch)
+		case <-p.announceFlush:
+			p.flushAnnouncements()
+
+		case <-p.refresh:
+			p.refreshSubscriptions()
+
+		case <-p.fragments.expire:
+			p.expireFragments()
+
+		case <-p.ordering.flush:
+			p.flushOrdering()
+
+		case job := <-p.shards.results:
+			p.shards.inflight--
+			p.handleValidated(job)
+
+		case dp := <-p.peerDead:
+			if dp.outgoing == nil {
+				// the peer went idle, an outbound stream won't help
+				p.handleDeadPeer(dp.pid)
+				continue
+			}
+
+			if ch, ok := p.peers[dp.pid]; !ok || ch != dp.outgoing {
+				// the session was replaced or dropped already
+				continue
 			}
 
-			delete(p.peers, pid)
-			for _, t := range p.topics {
-				delete(t, pid)
+			p.handleDeadPeer(dp.pid)
+			if pi, ok := p.directPeers[dp.pid]; ok {
+				go p.connectDirect(pi, directPeerRetryInterval)
+			} else if p.reconnect.attempts > 0 && p.host.Network().Connectedness(dp.pid) == inet.Connected {
+				// only the stream broke, e.g. it was reset
+				go p.reopenStream(dp.pid)
 			}
 		case treq := <-p.getTopics:
 			var out []string
@@ -135,10 +952,46 @@ func (p *PubSub) processLoop(ctx context.Context) {
 				out = append(out, t)
 			}
 			treq.resp <- out
+		case treq := <-p.getPeersTopics:
+			var out []string
+			for t := range p.topics {
+				out = append(out, t)
+			}
+			treq.resp <- out
+		case req := <-p.isSubscribed:
+			req.resp <- len(p.myTopics[req.topic]) > 0
+		case req := <-p.topicPeerCount:
+			req.resp <- len(p.topics[req.topic])
+		case req := <-p.seenCacheCh:
+			p.handleSeenCache(req)
 		case sub := <-p.cancelCh:
 			p.handleRemoveSubscription(sub)
+		case t := <-p.leave:
+			p.handleLeave(t)
+		case req := <-p.unsubTopic:
+			p.handleUnsubscribe(req)
 		case sub := <-p.addSub:
 			p.handleAddSubscription(sub)
+		case req := <-p.blacklistCh:
+			p.handleBlacklist(req)
+		case ch := <-p.addTopicEvts:
+			p.topicEvtSubs[ch] = struct{}{}
+		case ch := <-p.rmTopicEvts:
+			if _, ok := p.topicEvtSubs[ch]; ok {
+				delete(p.topicEvtSubs, ch)
+				close(ch)
+			}
+		case ch := <-p.addPeerEvts:
+			p.peerEvtSubs[ch] = struct{}{}
+		case ch := <-p.rmPeerEvts:
+			if _, ok := p.peerEvtSubs[ch]; ok {
+				delete(p.peerEvtSubs, ch)
+				close(ch)
+			}
+		case req := <-p.addVal:
+			p.handleAddValidator(req)
+		case req := <-p.rmVal:
+			p.handleRemoveValidator(req)
 		case preq := <-p.getPeers:
 			tmap, ok := p.topics[preq.topic]
 			if preq.topic != "" && !ok {
@@ -156,92 +1009,435 @@ func (p *PubSub) processLoop(ctx context.Context) {
 				peers = append(peers, p)
 			}
 			preq.resp <- peers
+		case req := <-p.getPeerScore:
+			p.handlePeerScore(req)
+		case req := <-p.getPeerInfo:
+			info, ok := p.peerInfos[req.peer]
+			req.resp <- peerInfoResp{info: info, ok: ok}
+		case req := <-p.getLastSeqno:
+			seqno, ok := p.lastSeqnos[req.peer]
+			req.resp <- lastSeqnoResp{seqno: seqno, ok: ok}
+		case req := <-p.getSnapshot:
+			p.handleSnapshot(req)
+		case req := <-p.getSubCounts:
+			req.resp <- p.subscriberCounts()
+		case req := <-p.setHost:
+			p.handleSetHost(req)
+		case req := <-p.getPeerTopics:
+			var out []string
+			for t, tmap := range p.topics {
+				if _, ok := tmap[req.peer]; ok {
+					out = append(out, t)
+				}
+			}
+			req.resp <- out
 		case rpc := <-p.incoming:
+			// count the RPC just taken, so a full queue reads as full
+			depth := len(p.incoming) + 1
+			p.metrics.setIncomingQueue(depth)
+			p.updateShedding(depth)
+
+			start := time.Now()
 			err := p.handleIncomingRPC(rpc)
+			p.metrics.observeEvent("rpc", start)
 			if err != nil {
-				log.Error("handling RPC: ", err)
+				p.log.Error("handling RPC: ", err)
 				continue
 			}
-		case msg := <-p.publish:
-			p.maybePublishMessage(p.host.ID(), msg.Message)
+		case req := <-p.publish:
+			start := time.Now()
+			p.handlePublish(req)
+			p.metrics.observeEvent("publish", start)
+		case <-p.closing:
+			p.log.Info("pubsub closed, processloop shutting down")
+			return
 		case <-ctx.Done():
-			log.Info("pubsub processloop shutting down")
+			p.log.Info("pubsub processloop shutting down")
 			return
 		}
 	}
 }
 
+// shutdown detaches from the host and releases all peers and subscriptions.
+// Only called from processLoop when it exits.
+func (p *PubSub) shutdown() {
+	for _, pid := range p.protocols {
+		p.host.RemoveStreamHandler(pid)
+	}
+	p.host.Network().StopNotify((*PubSubNotif)(p))
+
+	// writers blocked on a peer that stopped reading never get to see their
+	// queue closed, so close their streams from under them
+	p.closeStreams()
+
+	for pid, ch := range p.peers {
+		close(ch)
+		delete(p.peers, pid)
+		delete(p.peerSubs, pid)
+		delete(p.peerStreams, pid)
+	}
+	atomic.StoreInt32(&p.peerCount, 0)
+
+	for topic, subs := range p.myTopics {
+		for sub := range subs {
+			if sub.err != nil {
+				// closed already as a Subscription to another topic
+				continue
+			}
+			sub.err = p.closedErr()
+			close(sub.ch)
+		}
+		p.removeTopic(topic)
+	}
+
+	for sub := range p.allSubs {
+		sub.err = p.closedErr()
+		close(sub.ch)
+		delete(p.allSubs, sub)
+	}
+
+	for ch := range p.topicEvtSubs {
+		close(ch)
+		delete(p.topicEvtSubs, ch)
+	}
+
+	for ch := range p.peerEvtSubs {
+		close(ch)
+		delete(p.peerEvtSubs, ch)
+	}
+
+	p.stopObserver()
+	p.stopShards()
+	p.metrics.reset()
+
+	close(p.done)
+}
+
+// handlePublish publishes the messages of req.
+// Only called from processLoop.
+func (p *PubSub) handlePublish(req *publishReq) {
+	if req.batch != nil {
+		for _, msg := range req.batch {
+			count(&p.stats.Published)
+			p.maybePublishMessage(p.host.ID(), msg.Message, req.peers)
+		}
+		return
+	}
+
+	local := !p.noLoopback && p.subscribedToMsg(req.msg.Message)
+	if req.ifSubscribers && !local && !p.peersSubscribedToMsg(req.msg.Message) {
+		req.resp <- publishResult{skipped: true}
+		return
+	}
+
+	count(&p.stats.Published)
+	n, err := p.maybePublishMessage(p.host.ID(), req.msg.Message, req.peers)
+	if req.receipt != nil {
+		req.receipt(DeliveryReport{
+			Peers:     n,
+			Delivered: err == nil && !p.noLoopback && (p.subscribedToMsg(req.msg.Message) || len(p.allSubs) > 0),
+			Err:       err,
+		})
+	}
+	if req.resp != nil {
+		req.resp <- publishResult{peers: n, err: err}
+	}
+}
+
+// handleDeadPeer closes the outbound queue of a peer and forgets about its
+// subscriptions.
+// Only called from processLoop.
+func (p *PubSub) handleDeadPeer(pid peer.ID) {
+	ok := p.closeSession(pid)
+	delete(p.limiters, pid)
+	delete(p.scores, pid)
+	delete(p.lastSeqnos, pid)
+	atomic.StoreInt32(&p.peerCount, int32(len(p.peers)))
+	p.metrics.setPeers(len(p.peers))
+	if ok {
+		p.notifyPeerEvent(PeerEvent{Type: PeerDisconnected, Peer: pid})
+	}
+
+	for t := range p.topics {
+		p.removePeerTopic(pid, t)
+	}
+}
+
+// closeSession closes the outbound queue of a peer, letting its writer
+// flush what is queued, and returns whether we had a session with it.
+// Only called from processLoop.
+func (p *PubSub) closeSession(pid peer.ID) bool {
+	ch, ok := p.peers[pid]
+	if !ok {
+		return false
+	}
+
+	// let the writer flush what is queued, but not indefinitely
+	p.peerStreams[pid].SetWriteDeadline(time.Now().Add(p.drainTimeout))
+	close(ch)
+
+	delete(p.peers, pid)
+	delete(p.peerSubs, pid)
+	delete(p.peerStreams, pid)
+	delete(p.peerInfos, pid)
+	return true
+}
+
+// removePeerTopic records that pid left topic, and forgets about the topic
+// once no peer is left on it.
+// Only called from processLoop.
+func (p *PubSub) removePeerTopic(pid peer.ID, topic string) {
+	tmap, ok := p.topics[topic]
+	if !ok {
+		return
+	}
+
+	if _, ok := tmap[pid]; ok {
+		delete(tmap, pid)
+		p.notifyTopicEvent(TopicEvent{Type: PeerLeave, Peer: pid, Topic: topic})
+
+		p.peerTopicCount[pid]--
+		if p.peerTopicCount[pid] == 0 {
+			delete(p.peerTopicCount, pid)
+		}
+	}
+
+	if len(tmap) == 0 {
+		delete(p.topics, topic)
+		if prefix, ok := wildcardPrefix(topic); ok {
+			delete(p.peerPrefixes, prefix)
+		}
+	}
+}
+
 // handleRemoveSubscription removes Subscription sub from bookeeping.
 // If this was the last Subscription for a given topic, it will also announce
 // that this node is not subscribing to this topic anymore.
 // Only called from processLoop.
 func (p *PubSub) handleRemoveSubscription(sub *Subscription) {
-	subs := p.myTopics[sub.topic]
+	if len(sub.topics) == 0 {
+		if _, ok := p.allSubs[sub]; ok {
+			p.removeSubscription(sub)
+		}
+		return
+	}
+
+	// a Subscription is added to all its topics at once, so the first one
+	// tells whether it is still there
+	subs := p.myTopics[sub.topics[0]]
 
 	if subs == nil {
 		return
 	}
 
-	sub.err = fmt.Errorf("subscription cancelled by calling sub.Cancel()")
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	p.removeSubscription(sub)
+}
+
+// removeSubscription cancels sub and removes it from all its topics. It
+// announces that this node is not subscribing anymore to the topics sub was
+// the last Subscription for.
+// Only called from processLoop.
+func (p *PubSub) removeSubscription(sub *Subscription) {
+	sub.err = ErrSubscriptionCancelled
 	close(sub.ch)
-	delete(subs, sub)
+	delete(p.allSubs, sub)
 
-	if len(subs) == 0 {
-		delete(p.myTopics, sub.topic)
-		p.announce(sub.topic, false)
+	for _, topic := range sub.topics {
+		subs := p.myTopics[topic]
+		delete(subs, sub)
+
+		if len(subs) == 0 {
+			p.removeTopic(topic)
+
+			// peers keep sending us the topics we relay
+			if _, relay := p.relayTopics[topic]; !relay {
+				p.announce(topic, false)
+			}
+		}
+
+		p.metrics.setTopicSubscribers(topic, len(p.myTopics), len(subs))
 	}
 }
 
-// handleAddSubscription adds a Subscription for a particular topic. If it is
-// the first Subscription for the topic, it will announce that this node
-// subscribes to the topic.
+// handleUnsubscribe cancels all Subscriptions for a topic and announces that
+// this node is not subscribing to the topic anymore.
 // Only called from processLoop.
-func (p *PubSub) handleAddSubscription(req *addSubReq) {
+func (p *PubSub) handleUnsubscribe(req *unsubReq) {
 	subs := p.myTopics[req.topic]
 
-	// announce we want this topic
 	if len(subs) == 0 {
-		p.announce(req.topic, true)
+		req.resp <- fmt.Errorf("%w %s", ErrNotSubscribed, req.topic)
+		return
 	}
 
-	// make new if not there
-	if subs == nil {
-		p.myTopics[req.topic] = make(map[*Subscription]struct{})
-		subs = p.myTopics[req.topic]
+	// Subscriptions to several topics are cancelled as a whole, which
+	// leaves their other topics too if nothing else subscribed to them
+	for sub := range subs {
+		p.removeSubscription(sub)
 	}
 
-	sub := &Subscription{
-		ch:       make(chan *Message, 32),
-		topic:    req.topic,
-		cancelCh: p.cancelCh,
+	req.resp <- nil
+}
+
+// removeTopic forgets about a topic we don't have any Subscriptions for
+// anymore.
+// Only called from processLoop.
+func (p *PubSub) removeTopic(topic string) {
+	delete(p.myTopics, topic)
+	delete(p.replay, topic)
+	if prefix, ok := wildcardPrefix(topic); ok {
+		delete(p.myPrefixes, prefix)
+	}
+	p.resetPublishRate(topic)
+}
+
+// handleAddSubscription adds a Subscription for its topics. For each topic it
+// is the first Subscription for, it will announce that this node subscribes
+// to the topic.
+// Only called from processLoop.
+func (p *PubSub) handleAddSubscription(req *addSubReq) {
+	sub := req.sub
+	if sub.joined != nil && sub.joined.left {
+		// the handle was closed while the request was on its way
+		req.resp <- nil
+		return
 	}
 
-	p.myTopics[sub.topic][sub] = struct{}{}
+	sub.ch = make(chan *Message, sub.bufSize)
+	sub.cancelCh = p.cancelCh
+	sub.done = p.done
+
+	for _, topic := range sub.topics {
+		subs := p.myTopics[topic]
+
+		// announce we want this topic
+		if len(subs) == 0 {
+			p.announce(topic, true)
+		}
+
+		// make new if not there
+		if subs == nil {
+			subs = make(map[*Subscription]struct{})
+			p.myTopics[topic] = subs
+
+			if prefix, ok := wildcardPrefix(topic); ok {
+				p.myPrefixes[prefix] = struct{}{}
+			}
+		}
+
+		subs[sub] = struct{}{}
+		p.metrics.setTopicSubscribers(topic, len(p.myTopics), len(subs))
+	}
 
+	if len(sub.topics) == 0 {
+		p.allSubs[sub] = struct{}{}
+	}
+
+	p.replayTo(sub)
 	req.resp <- sub
 }
 
-// announce announces whether or not this node is interested in a given topic
+// announce announces whether or not this node is interested in a given
+// topic. With announce batching enabled, the change is queued and sent along
+// with the other changes made until the batch is due.
 // Only called from processLoop.
 func (p *PubSub) announce(topic string, sub bool) {
-	subopt := &pb.RPC_SubOpts{
-		Topicid:   &topic,
-		Subscribe: &sub,
+	// only the latest change to a topic matters
+	p.pendingAnnounce[topic] = sub
+
+	if p.announceDelay == 0 {
+		p.flushAnnouncements()
+		return
+	}
+
+	if p.announceFlush == nil {
+		p.announceFlush = time.After(p.announceDelay)
+	}
+}
+
+// flushAnnouncements sends the queued announcements to all our peers. They go
+// through the subscription queue of each peer rather than its message queue,
+// as dropping one would leave the peer with a wrong view of our topics. The
+// queue keeps them until they are written, retrying temporary write errors,
+// or the peer is gone and handleDeadPeer drops the queue.
+// Only called from processLoop.
+func (p *PubSub) flushAnnouncements() {
+	p.announceFlush = nil
+
+	subs := make([]*pb.RPC_SubOpts, 0, len(p.pendingAnnounce))
+	for topic, sub := range p.pendingAnnounce {
+		subs = append(subs, &pb.RPC_SubOpts{
+			Topicid:   proto.String(topic),
+			Subscribe: proto.Bool(sub),
+		})
+		delete(p.pendingAnnounce, topic)
+	}
+
+	for _, q := range p.peerSubs {
+		q.push(subs)
 	}
+}
+
+// refreshSubscriptions announces all our subscriptions to all our peers.
+// Only called from processLoop.
+func (p *PubSub) refreshSubscriptions() {
+	p.refresh = time.After(p.refreshInterval)
 
-	out := rpcWithSubs(subopt)
-	for _, peer := range p.peers {
-		peer <- out
+	subs := p.getHelloPacket().Subscriptions
+	for _, q := range p.peerSubs {
+		q.push(subs)
 	}
 }
 
-// notifySubs sends a given message to all corresponding subscribbers.
+// notifySubs sends a given message to all corresponding subscribbers. Each
+// subscriber gets the message once, even if it matches several of its topics.
 // Only called from processLoop.
-func (p *PubSub) notifySubs(msg *pb.Message) {
+func (p *PubSub) notifySubs(msg *pb.Message, received time.Time) {
+	// the topic each subscriber matched on
+	tonotify := make(map[*Subscription]string)
 	for _, topic := range msg.GetTopicIDs() {
-		subs := p.myTopics[topic]
-		for f := range subs {
-			f.ch <- &Message{msg}
+		p.recordReplay(topic, topic, msg, received)
+		for f := range p.myTopics[topic] {
+			if _, ok := tonotify[f]; !ok {
+				tonotify[f] = topic
+			}
+		}
+	}
+
+	for prefix := range p.myPrefixes {
+		topic, ok := msgTopicWithPrefix(msg, prefix)
+		if !ok {
+			continue
+		}
+
+		p.recordReplay(prefix+TopicWildcard, topic, msg, received)
+		for f := range p.myTopics[prefix+TopicWildcard] {
+			if _, ok := tonotify[f]; !ok {
+				tonotify[f] = topic
+			}
+		}
+	}
+
+	if len(p.allSubs) > 0 {
+		first := msg.GetTopicIDs()[0]
+		for f := range p.allSubs {
+			tonotify[f] = first
+		}
+	}
+
+	for f, topic := range tonotify {
+		m := &Message{Message: msg, MatchedTopic: topic, ReceivedAt: received}
+		if !f.accepts(m) {
+			continue
+		}
+
+		if !f.deliver(m) {
+			p.log.Infof("dropping message for subscription to %s: buffer full", topic)
+			count(&p.stats.DroppedSubscriberFull)
 		}
 	}
 }
@@ -256,11 +1452,34 @@ func (p *PubSub) markSeen(id string) {
 	p.seenMessages.Add(id)
 }
 
-// subscribedToMessage returns whether we are subscribed to one of the topics
-// of a given message
-func (p *PubSub) subscribedToMsg(msg *pb.Message) bool {
+// subscribedToMessage returns whether we are subscribed to one of the topics
+// of a given message
+func (p *PubSub) subscribedToMsg(msg *pb.Message) bool {
+	for _, t := range msg.GetTopicIDs() {
+		if _, ok := p.myTopics[t]; ok {
+			return true
+		}
+	}
+
+	for prefix := range p.myPrefixes {
+		if msgHasTopicPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// peersSubscribedToMsg returns whether any of our peers is subscribed to one
+// of the topics of a given message
+func (p *PubSub) peersSubscribedToMsg(msg *pb.Message) bool {
 	for _, t := range msg.GetTopicIDs() {
-		if _, ok := p.myTopics[t]; ok {
+		if len(p.topics[t]) > 0 {
+			return true
+		}
+	}
+
+	for prefix := range p.peerPrefixes {
+		if msgHasTopicPrefix(msg, prefix) && len(p.topics[prefix+TopicWildcard]) > 0 {
 			return true
 		}
 	}
@@ -268,58 +1487,296 @@ func (p *PubSub) subscribedToMsg(msg *pb.Message) bool {
 }
 
 func (p *PubSub) handleIncomingRPC(rpc *RPC) error {
+	if _, ok := p.blacklist[rpc.from]; ok {
+		p.log.Debugf("dropping RPC from blacklisted peer %s", rpc.from)
+		return nil
+	}
+
+	if ext := rpc.GetHello(); ext != nil {
+		p.notifyPeerEvent(PeerEvent{Type: PeerHello, Peer: rpc.from, Hello: ext})
+	}
+
+	if p.peerExchange && len(rpc.GetExchange()) > 0 {
+		p.handleExchange(rpc.from, rpc.GetExchange())
+	}
+
+	var joined []string
 	for _, subopt := range rpc.GetSubscriptions() {
 		t := subopt.GetTopicid()
 		if subopt.GetSubscribe() {
+			if err := p.checkTopics([]string{t}); err != nil {
+				p.log.Infof("ignoring subscription of %s: %s", rpc.from, err)
+				count(&p.stats.RejectedSubscriptions)
+				continue
+			}
+
 			tmap, ok := p.topics[t]
+			if _, joined := tmap[rpc.from]; joined {
+				continue
+			}
+
+			if p.maxTopicsPerPeer > 0 && p.peerTopicCount[rpc.from] >= p.maxTopicsPerPeer {
+				p.log.Infof("ignoring subscription of %s to %s: peer is on too many topics", rpc.from, t)
+				count(&p.stats.RejectedSubscriptions)
+				continue
+			}
+
 			if !ok {
 				tmap = make(map[peer.ID]struct{})
 				p.topics[t] = tmap
+
+				if prefix, ok := wildcardPrefix(t); ok {
+					p.peerPrefixes[prefix] = struct{}{}
+				}
 			}
 
 			tmap[rpc.from] = struct{}{}
+			p.peerTopicCount[rpc.from]++
+			p.notifyTopicEvent(TopicEvent{Type: PeerJoin, Peer: rpc.from, Topic: t})
+			joined = append(joined, t)
 		} else {
-			tmap, ok := p.topics[t]
-			if !ok {
-				continue
-			}
-			delete(tmap, rpc.from)
+			p.removePeerTopic(rpc.from, t)
 		}
 	}
 
+	if p.peerExchange && len(joined) > 0 {
+		p.sendExchange(rpc.from, joined)
+	}
+
+	score := p.scoreOf(rpc.from)
 	for _, pmsg := range rpc.GetPublish() {
-		if !p.subscribedToMsg(pmsg) {
-			log.Warning("received message we didn't subscribe to. Dropping.")
+		count(&p.stats.Received)
+		p.metrics.messageIn()
+		if score != nil {
+			score.Messages++
+		}
+
+		err := p.checkTopics(pmsg.GetTopicIDs())
+		if err == nil {
+			err = p.checkSeqno(pmsg.GetSeqno())
+		}
+		if err != nil {
+			p.log.Infof("dropping malformed message from %s: %s", rpc.from, err)
+			count(&p.stats.DroppedMalformed)
+			if score != nil {
+				score.Invalid++
+			}
+			continue
+		}
+
+		// the author is up to the sender, and ends up as a key in our
+		// maps, so it should at least be a peer ID
+		if _, err := peer.IDFromBytes(pmsg.GetFrom()); err != nil {
+			p.log.Infof("dropping message from %s with invalid author: %s", rpc.from, err)
+			count(&p.stats.DroppedInvalidFrom)
+			if score != nil {
+				score.Invalid++
+			}
+			continue
+		}
+
+		if p.shedsMsg(pmsg) {
+			p.log.Debugf("dropping message from %s: shedding load", rpc.from)
+			count(&p.stats.DroppedLoadShed)
+			continue
+		}
+
+		if !p.allowMessage(rpc.from) {
+			p.log.Debugf("dropping message from %s: rate limit exceeded", rpc.from)
+			count(&p.stats.DroppedRateLimited)
+
+			if p.exceededRateLimit(rpc.from) {
+				p.log.Warningf("blacklisting peer %s for exceeding the rate limit", rpc.from)
+				p.handleBlacklist(&blacklistReq{peer: rpc.from, blacklist: true})
+				return nil
+			}
 			continue
 		}
 
-		p.maybePublishMessage(rpc.from, pmsg)
+		if !p.subscribedToMsg(pmsg) && !p.relaysMsg(pmsg) {
+			p.log.Warning("received message we didn't subscribe to. Dropping.")
+			count(&p.stats.DroppedNotSubscribed)
+			continue
+		}
+
+		p.maybePublishMessage(rpc.from, pmsg, nil)
+	}
+	return nil
+}
+
+// checkTopics fails if the topic list of a message is empty, or holds an
+// empty topic, one longer than MaxTopicLength or one rejected by the check
+// set with WithTopicValidator.
+func (p *PubSub) checkTopics(topics []string) error {
+	if len(topics) == 0 {
+		return fmt.Errorf("no topics")
+	}
+
+	for _, t := range topics {
+		if t == "" {
+			return fmt.Errorf("empty topic")
+		}
+		if len(t) > MaxTopicLength {
+			return fmt.Errorf("topic of %d bytes exceeds the maximum of %d bytes", len(t), MaxTopicLength)
+		}
+		if p.topicCheck != nil {
+			if err := p.topicCheck(t); err != nil {
+				return fmt.Errorf("invalid topic %q: %s", t, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSeqno fails if seqno doesn't have the length set with
+// WithSeqnoLength. Shorter seqnos make distinct messages more likely to
+// share an ID.
+func (p *PubSub) checkSeqno(seqno []byte) error {
+	if p.seqnoLen > 0 && len(seqno) != p.seqnoLen {
+		return fmt.Errorf("seqno of %d bytes, expected %d bytes", len(seqno), p.seqnoLen)
 	}
 	return nil
 }
 
-// msgID returns a unique ID of the passed Message
-func msgID(pmsg *pb.Message) string {
+// dedupTopics returns topics without duplicates, in their original order.
+func dedupTopics(topics []string) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, t := range topics {
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+	return out
+}
+
+// MsgIdFunction returns the ID of a message, used to detect duplicates
+type MsgIdFunction func(pmsg *pb.Message) string
+
+// DefaultMsgIdFn returns a unique ID of the passed Message, made up of its
+// origin and seqno
+func DefaultMsgIdFn(pmsg *pb.Message) string {
 	return string(pmsg.GetFrom()) + string(pmsg.GetSeqno())
 }
 
-func (p *PubSub) maybePublishMessage(from peer.ID, pmsg *pb.Message) {
-	id := msgID(pmsg)
+// maybePublishMessage delivers a message we haven't seen before to our
+// subscribers and forwards it to our peers, or only those in to if it is not
+// nil. It returns the number of peers the message was queued to, and
+// ErrValidationFailed if the message failed validation.
+func (p *PubSub) maybePublishMessage(from peer.ID, pmsg *pb.Message, to map[peer.ID]struct{}) (int, error) {
+	score := p.scoreOf(from)
+
+	if from != p.host.ID() && peer.ID(pmsg.GetFrom()) == p.host.ID() {
+		// our own message came back, possibly with a seqno we never
+		// used; we delivered and sent it when publishing it
+		count(&p.stats.DroppedLoopback)
+		if score != nil {
+			score.Duplicates++
+		}
+		return 0, nil
+	}
+
+	id := p.msgID(pmsg)
 	if p.seenMessage(id) {
-		return
+		count(&p.stats.DroppedSeen)
+		if score != nil {
+			score.Duplicates++
+		}
+		return 0, nil
 	}
 
 	p.markSeen(id)
+	p.trackSeqno(pmsg)
+	received := time.Now()
+
+	// validators and subscribers see the plaintext, peers get the message
+	// as it arrived
+	dmsg, ok := p.decrypt(pmsg)
+	if !ok {
+		count(&p.stats.DroppedDecryption)
+		return 0, nil
+	}
+
+	if !p.knowsCodec(dmsg) {
+		// we can't look inside, but peers with the codec can
+		p.log.Debugf("relaying message from %s undelivered: unknown codec %s", from, dmsg.GetCompression())
+		count(&p.stats.DroppedCompression)
+		return p.publishMessage(from, pmsg, to)
+	}
+
+	dmsg, ok = p.decompress(dmsg)
+	if !ok {
+		count(&p.stats.DroppedCompression)
+		return 0, nil
+	}
+
+	if p.fragments.size > 0 && isFragment(dmsg) {
+		return p.handleFragment(from, pmsg, dmsg, to, received)
+	}
+
+	if p.shards.queues != nil && from != p.host.ID() {
+		// publishers wait for the outcome of their own messages, so
+		// only messages of peers are validated by the workers
+		p.dispatchValidation(&validationJob{
+			from:     from,
+			pmsg:     pmsg,
+			dmsg:     dmsg,
+			to:       to,
+			received: received,
+			vals:     p.validatorsFor(dmsg),
+		})
+		return 0, nil
+	}
+
+	if !p.validate(from, dmsg) {
+		count(&p.stats.DroppedValidation)
+		p.metrics.validationFailure()
+		if score != nil {
+			score.Invalid++
+		}
+		return 0, ErrValidationFailed
+	}
+
+	return p.acceptMessage(from, pmsg, dmsg, to, received)
+}
+
+// acceptMessage delivers and forwards a valid message, unless its content
+// is a duplicate. dmsg is the decrypted pmsg.
+// Only called from processLoop.
+func (p *PubSub) acceptMessage(from peer.ID, pmsg, dmsg *pb.Message, to map[peer.ID]struct{}, received time.Time) (int, error) {
+	score := p.scoreOf(from)
+
+	if !p.markContent(dmsg) {
+		count(&p.stats.DroppedContentDup)
+		if score != nil {
+			score.Duplicates++
+		}
+		return 0, nil
+	}
+
+	if score != nil {
+		score.Delivered++
+	}
 
-	p.notifySubs(pmsg)
+	p.observe(dmsg, received)
+	p.deliverMessage(from, dmsg, received)
 
-	err := p.publishMessage(from, pmsg)
+	n, err := p.publishMessage(from, pmsg, to)
 	if err != nil {
-		log.Error("publish message: ", err)
+		p.log.Error("publish message: ", err)
 	}
+	return n, nil
 }
 
-func (p *PubSub) publishMessage(from peer.ID, msg *pb.Message) error {
+// publishMessage queues a message to our peers subscribed to it, or only
+// those in to if it is not nil, and returns how many peers it was queued to.
+func (p *PubSub) publishMessage(from peer.ID, msg *pb.Message, to map[peer.ID]struct{}) (int, error) {
+	if p.leaf && from != p.host.ID() {
+		return 0, nil
+	}
+
 	tosend := make(map[peer.ID]struct{})
 	for _, topic := range msg.GetTopicIDs() {
 		tmap, ok := p.topics[topic]
@@ -332,52 +1789,200 @@ func (p *PubSub) publishMessage(from peer.ID, msg *pb.Message) error {
 		}
 	}
 
-	out := rpcWithMessages(msg)
+	for prefix := range p.peerPrefixes {
+		if !msgHasTopicPrefix(msg, prefix) {
+			continue
+		}
+
+		for pid := range p.topics[prefix+TopicWildcard] {
+			tosend[pid] = struct{}{}
+		}
+	}
+
+	if from != p.host.ID() && msg.Ttl != nil {
+		// the message came from a peer and has a limited lifetime
+		ttl := msg.GetTtl()
+		if ttl == 0 {
+			return 0, nil
+		}
+
+		fwd := *msg
+		ttl--
+		fwd.Ttl = &ttl
+		msg = &fwd
+	}
+
+	var candidates []peer.ID
 	for pid := range tosend {
 		if pid == from || pid == peer.ID(msg.GetFrom()) {
 			continue
 		}
 
+		if to != nil {
+			if _, ok := to[pid]; !ok {
+				continue
+			}
+		}
+
+		if _, ok := p.peers[pid]; ok {
+			candidates = append(candidates, pid)
+		}
+	}
+
+	if p.forwardPolicy != nil && len(candidates) > 0 {
+		candidates = p.applyForwardPolicy(msg, candidates)
+	}
+	if p.maxDegree > 0 && len(candidates) > p.maxDegree {
+		candidates = pickRandom(candidates, p.maxDegree)
+	}
+
+	sent := 0
+	out := rpcWithMessages(msg)
+	for _, pid := range candidates {
 		mch, ok := p.peers[pid]
 		if !ok {
 			continue
 		}
 
-		go func() { mch <- out }()
+		if p.sendToPeer(pid, mch, out) {
+			sent++
+			count(&p.stats.Forwarded)
+			p.metrics.messageOut()
+		}
 	}
 
-	return nil
+	return sent, nil
 }
 
 type addSubReq struct {
-	topic string
-	resp  chan *Subscription
+	sub  *Subscription
+	resp chan *Subscription
 }
 
 // Subscribe returns a new Subscription for the given topic
-func (p *PubSub) Subscribe(topic string) (*Subscription, error) {
+func (p *PubSub) Subscribe(topic string, opts ...SubOpt) (*Subscription, error) {
+	return p.SubscribeCtx(context.Background(), topic, opts...)
+}
+
+// SubscribeCtx is like Subscribe, but gives up and returns ctx.Err() if ctx
+// is done before the event loop takes the subscription.
+func (p *PubSub) SubscribeCtx(ctx context.Context, topic string, opts ...SubOpt) (*Subscription, error) {
 	td := pb.TopicDescriptor{Name: &topic}
 
-	return p.SubscribeByTopicDescriptor(&td)
+	return p.subscribe(ctx, &td, opts)
 }
 
 // SubscribeByTopicDescriptor lets you subscribe a topic using a pb.TopicDescriptor
-func (p *PubSub) SubscribeByTopicDescriptor(td *pb.TopicDescriptor) (*Subscription, error) {
+func (p *PubSub) SubscribeByTopicDescriptor(td *pb.TopicDescriptor, opts ...SubOpt) (*Subscription, error) {
+	return p.subscribe(context.Background(), td, opts)
+}
+
+func (p *PubSub) subscribe(ctx context.Context, td *pb.TopicDescriptor, opts []SubOpt) (*Subscription, error) {
 	if td.GetAuth().GetMode() != pb.TopicDescriptor_AuthOpts_NONE {
-		return nil, fmt.Errorf("auth mode not yet supported")
+		return nil, fmt.Errorf("%w: %s", ErrAuthUnsupported, td.GetAuth().GetMode())
 	}
 
 	if td.GetEnc().GetMode() != pb.TopicDescriptor_EncOpts_NONE {
-		return nil, fmt.Errorf("encryption mode not yet supported")
+		return nil, fmt.Errorf("%w: %s", ErrEncUnsupported, td.GetEnc().GetMode())
+	}
+
+	return p.subscribeTopics(ctx, []string{td.GetName()}, nil, opts)
+}
+
+// SubscribeTopics returns a new Subscription receiving the messages on any of
+// the given topics. A message on several of them is delivered once, with
+// MatchedTopic set to the first of its topics the Subscription matched.
+// Cancelling the Subscription, or unsubscribing from any of its topics,
+// cancels it for all of them.
+func (p *PubSub) SubscribeTopics(topics []string, opts ...SubOpt) (*Subscription, error) {
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("no topics to subscribe to")
+	}
+
+	return p.subscribeTopics(context.Background(), topics, nil, opts)
+}
+
+// SubscribeAll returns a new Subscription receiving every message we
+// accept, whatever its topic, with MatchedTopic set to the first topic of
+// the message. It doesn't announce interest in any topic, so peers keep
+// sending us only the messages on the topics we are subscribed to: it sees
+// those, and the messages we publish ourselves. It can't replay messages.
+func (p *PubSub) SubscribeAll(opts ...SubOpt) (*Subscription, error) {
+	return p.subscribeTopics(context.Background(), nil, nil, opts)
+}
+
+// subscribeTopics subscribes to topics, through the handle joined if it is
+// not nil.
+func (p *PubSub) subscribeTopics(ctx context.Context, topics []string, joined *Topic, opts []SubOpt) (*Subscription, error) {
+	// SubscribeAll has no topics to check
+	if len(topics) > 0 {
+		if err := p.checkTopics(topics); err != nil {
+			return nil, fmt.Errorf("cannot subscribe: %s", err)
+		}
+	}
+
+	sub := &Subscription{
+		topics:  dedupTopics(topics),
+		joined:  joined,
+		bufSize: DefaultSubscriptionBufferSize,
+		policy:  DropNewest,
+		timeout: DefaultDeliveryTimeout,
+	}
+
+	for _, opt := range opts {
+		err := opt(sub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sub.replay > 0 && len(sub.topics) == 0 {
+		return nil, fmt.Errorf("replay needs a topic")
+	}
+	if sub.replay > sub.bufSize {
+		return nil, fmt.Errorf("replay size %d exceeds buffer size %d", sub.replay, sub.bufSize)
 	}
 
 	out := make(chan *Subscription, 1)
-	p.addSub <- &addSubReq{
-		topic: td.GetName(),
+	select {
+	case p.addSub <- &addSubReq{
+		sub:  sub,
+		resp: out,
+	}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, p.closedErr()
+	}
+
+	// processLoop answers right away once it took the request
+	sub = <-out
+	if sub == nil {
+		return nil, fmt.Errorf("topic %s already closed", joined.topic)
+	}
+	return sub, nil
+}
+
+type unsubReq struct {
+	topic string
+	resp  chan error
+}
+
+// Unsubscribe cancels all Subscriptions for the given topic and announces to
+// our peers that we left the topic. It returns an error if we aren't
+// subscribed to the topic.
+func (p *PubSub) Unsubscribe(topic string) error {
+	out := make(chan error, 1)
+	select {
+	case p.unsubTopic <- &unsubReq{
+		topic: topic,
 		resp:  out,
+	}:
+	case <-p.done:
+		return p.closedErr()
 	}
 
-	return <-out, nil
+	return <-out
 }
 
 type topicReq struct {
@@ -386,38 +1991,288 @@ type topicReq struct {
 
 // GetTopics returns the topics this node is subscribed to
 func (p *PubSub) GetTopics() []string {
+	topics, _ := p.GetTopicsCtx(context.Background())
+	return topics
+}
+
+// GetTopicsCtx is like GetTopics, but gives up and returns ctx.Err() if ctx
+// is done before the event loop takes the request.
+func (p *PubSub) GetTopicsCtx(ctx context.Context) ([]string, error) {
+	out := make(chan []string, 1)
+	select {
+	case p.getTopics <- &topicReq{resp: out}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, p.closedErr()
+	}
+	return <-out, nil
+}
+
+// DiscoveredTopics returns the topics our peers announced they are
+// subscribed to, whether we are subscribed to them or not. Only the peers
+// we are directly connected to announce their topics to us, so topics of
+// peers further away in the network are missing.
+func (p *PubSub) DiscoveredTopics() []string {
 	out := make(chan []string, 1)
-	p.getTopics <- &topicReq{resp: out}
+	select {
+	case p.getPeersTopics <- &topicReq{resp: out}:
+	case <-p.done:
+		return nil
+	}
+	return <-out
+}
+
+type isSubscribedReq struct {
+	topic string
+	resp  chan bool
+}
+
+// IsSubscribed returns whether we have a Subscription for the given topic,
+// i.e. whether GetTopics would list it
+func (p *PubSub) IsSubscribed(topic string) bool {
+	out := make(chan bool, 1)
+	select {
+	case p.isSubscribed <- &isSubscribedReq{topic: topic, resp: out}:
+	case <-p.done:
+		return false
+	}
+	return <-out
+}
+
+type topicPeerCountReq struct {
+	topic string
+	resp  chan int
+}
+
+// TopicPeerCount returns the number of peers subscribed to the given topic.
+// It only counts the peers we are directly connected to, as announced by
+// them, not the subscribers further away in the network. Peers subscribed
+// to a prefix matching the topic are not counted.
+func (p *PubSub) TopicPeerCount(topic string) int {
+	out := make(chan int, 1)
+	select {
+	case p.topicPeerCount <- &topicPeerCountReq{topic: topic, resp: out}:
+	case <-p.done:
+		return 0
+	}
 	return <-out
 }
 
 // Publish publishes data under the given topic
 func (p *PubSub) Publish(topic string, data []byte) error {
-	seqno := make([]byte, 8)
-	binary.BigEndian.PutUint64(seqno, uint64(time.Now().UnixNano()))
-
-	p.publish <- &Message{
-		&pb.Message{
-			Data:     data,
-			TopicIDs: []string{topic},
-			From:     []byte(p.host.ID()),
-			Seqno:    seqno,
+	return p.PublishMany([]string{topic}, data)
+}
+
+// PublishMany publishes data as a single message carrying all of the given
+// topics. Peers and local subscribers interested in any of the topics receive
+// the message once, as it is deduplicated under a single seqno.
+func (p *PubSub) PublishMany(topics []string, data []byte) error {
+	msgs, err := p.newFragments(topics, data, nil)
+	if err != nil {
+		return err
+	}
+
+	return p.publishFragments(msgs, nil)
+}
+
+// newMessage builds a message of ours carrying data under the given topics.
+// ttl limits how far the message travels, nil meaning no limit.
+func (p *PubSub) newMessage(topics []string, data []byte, ttl *uint32) (*Message, error) {
+	return p.newMessageWithSeqno(topics, data, ttl, p.nextSeqno())
+}
+
+// newMessageWithSeqno is newMessage for a seqno allocated by the caller.
+func (p *PubSub) newMessageWithSeqno(topics []string, data []byte, ttl *uint32, seqno []byte) (*Message, error) {
+	err := p.checkTopics(topics)
+	if err != nil {
+		return nil, fmt.Errorf("cannot publish message: %s", err)
+	}
+
+	tids := dedupTopics(topics)
+	err = p.waitPublishRate(tids)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypted data doesn't compress, so compress first
+	data, codec, err := p.compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := p.cipherFor(tids)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		data, err = c.Encrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting message: %s", err)
+		}
+	}
+
+	msg := &Message{
+		Message: &pb.Message{
+			Data:        data,
+			TopicIDs:    tids,
+			From:        []byte(p.Host().ID()),
+			Seqno:       seqno,
+			Ttl:         ttl,
+			Compression: codec,
 		},
 	}
+
+	err = p.checkMessageSize(msg.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// checkMessageSize fails if an RPC carrying pmsg would exceed the maximum
+// message size.
+func (p *PubSub) checkMessageSize(pmsg *pb.Message) error {
+	if size := proto.Size(&rpcWithMessages(pmsg).RPC); size > p.maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum message size of %d bytes", size, p.maxMessageSize)
+	}
 	return nil
 }
 
+// publishReq asks processLoop to publish a message of ours
+type publishReq struct {
+	msg *Message
+
+	// batch, if not nil, holds the messages of a PublishBatch, which are
+	// published instead of msg
+	batch []*Message
+
+	// peers, if not nil, restricts the peers we send the message to
+	peers map[peer.ID]struct{}
+
+	// resp, if not nil, receives the outcome of publishing the message
+	resp chan publishResult
+
+	// ifSubscribers skips the message if neither we nor our peers are
+	// subscribed to it. Requires resp.
+	ifSubscribers bool
+
+	// receipt, if not nil, is called with the outcome of publishing the
+	// message
+	receipt func(DeliveryReport)
+}
+
+// publishResult is the outcome of a publishReq
+type publishResult struct {
+	// peers is the number of peers the message was queued to
+	peers int
+	err   error
+
+	// skipped is set if the message wasn't published for lack of
+	// subscribers
+	skipped bool
+}
+
+// pushPublish hands a publish request to processLoop
+func (p *PubSub) pushPublish(req *publishReq) error {
+	select {
+	case p.publish <- req:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	case <-p.done:
+		return p.closedErr()
+	}
+}
+
+// nextSeqno returns the seqno for the next message we publish. Seqnos are
+// strictly increasing, regardless of adjustments to the system clock, and
+// start from the time the PubSub was created so they don't repeat the ones
+// used before a restart.
+func (p *PubSub) nextSeqno() []byte {
+	seqno := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqno, atomic.AddUint64(&p.counter, 1))
+	return seqno
+}
+
 type listPeerReq struct {
 	resp  chan []peer.ID
 	topic string
 }
 
+type peerTopicsReq struct {
+	peer peer.ID
+	resp chan []string
+}
+
+// PeerTopics returns the topics the given peer has announced interest in
+func (p *PubSub) PeerTopics(pid peer.ID) []string {
+	out := make(chan []string, 1)
+	select {
+	case p.getPeerTopics <- &peerTopicsReq{peer: pid, resp: out}:
+	case <-p.done:
+		return nil
+	}
+	return <-out
+}
+
 // ListPeers returns a list of peers we are connected to.
 func (p *PubSub) ListPeers(topic string) []peer.ID {
-	out := make(chan []peer.ID)
-	p.getPeers <- &listPeerReq{
+	peers, _ := p.ListPeersCtx(context.Background(), topic)
+	return peers
+}
+
+// ListPeersCtx is like ListPeers, but gives up and returns ctx.Err() if ctx
+// is done before the event loop takes the request.
+func (p *PubSub) ListPeersCtx(ctx context.Context, topic string) ([]peer.ID, error) {
+	out := make(chan []peer.ID, 1)
+	select {
+	case p.getPeers <- &listPeerReq{
 		resp:  out,
 		topic: topic,
+	}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, p.closedErr()
 	}
-	return <-out
+	return <-out, nil
+}
+
+// PeerCount returns the number of peers we have a pubsub session with.
+// Unlike ListPeers it does not go through the event loop, so the result may
+// briefly lag behind peers joining or leaving.
+func (p *PubSub) PeerCount() int {
+	return int(atomic.LoadInt32(&p.peerCount))
+}
+
+// WaitForPeers blocks until we have a pubsub session with at least n peers.
+// It returns ctx.Err() if ctx is done first, and an error if the PubSub is
+// closed while waiting.
+func (p *PubSub) WaitForPeers(ctx context.Context, n int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe before checking, so no session starting in between is
+	// missed
+	evts, err := p.SubscribePeerEvents(ctx)
+	if err != nil {
+		return err
+	}
+
+	for p.PeerCount() < n {
+		select {
+		case _, ok := <-evts:
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				return p.closedErr()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
@@ -3,15 +3,28 @@ package floodsub
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	ggio "github.com/gogo/protobuf/io"
+	proto "github.com/gogo/protobuf/proto"
 	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
 	netutil "github.com/libp2p/go-libp2p-netutil"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	prometheus "github.com/prometheus/client_golang/prometheus"
 	//bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	bhost "github.com/libp2p/go-libp2p-blankhost"
 )
@@ -80,10 +93,18 @@ func connectAll(t *testing.T, hosts []host.Host) {
 	}
 }
 
-func getPubsubs(ctx context.Context, hs []host.Host) []*PubSub {
+func getPubsub(ctx context.Context, h host.Host, opts ...Option) *PubSub {
+	ps, err := NewFloodSub(ctx, h, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func getPubsubs(ctx context.Context, hs []host.Host, opts ...Option) []*PubSub {
 	var psubs []*PubSub
 	for _, h := range hs {
-		psubs = append(psubs, NewFloodSub(ctx, h))
+		psubs = append(psubs, getPubsub(ctx, h, opts...))
 	}
 	return psubs
 }
@@ -289,7 +310,7 @@ func TestSelfReceive(t *testing.T) {
 
 	host := getNetHosts(t, ctx, 1)[0]
 
-	psub := NewFloodSub(ctx, host)
+	psub := getPubsub(ctx, host)
 
 	msg := []byte("hello world")
 
@@ -414,7 +435,7 @@ func TestSubReporting(t *testing.T) {
 	defer cancel()
 
 	host := getNetHosts(t, ctx, 1)[0]
-	psub := NewFloodSub(ctx, host)
+	psub := getPubsub(ctx, host)
 
 	fooSub, err := psub.Subscribe("foo")
 	if err != nil {
@@ -564,3 +585,5715 @@ func assertPeerList(t *testing.T, peers []peer.ID, expected ...peer.ID) {
 		}
 	}
 }
+
+func TestCloseStalledPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0])
+
+	// a peer which accepts our stream but never reads from it
+	stalled := make(chan struct{})
+	defer close(stalled)
+	hosts[1].SetStreamHandler(ID, func(s inet.Stream) {
+		<-stalled
+	})
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 50)
+
+	closed := make(chan struct{})
+	go func() {
+		psub.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Close blocked on a peer that stopped reading")
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[0].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	err = psubs[0].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing again must not block or panic
+	err = psubs[0].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sub.Next(ctx)
+	if err != ErrPubSubClosed {
+		t.Fatalf("expected %v from Next, got %v", ErrPubSubClosed, err)
+	}
+
+	cancelled := make(chan struct{})
+	go func() {
+		sub.Cancel()
+		close(cancelled)
+	}()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Cancel blocked after Close")
+	}
+
+	err = psubs[0].Publish("foobar", []byte("hello"))
+	if err != ErrPubSubClosed {
+		t.Fatalf("expected %v from Publish, got %v", ErrPubSubClosed, err)
+	}
+
+	_, err = psubs[0].Subscribe("foobar")
+	if err != ErrPubSubClosed {
+		t.Fatalf("expected %v from Subscribe, got %v", ErrPubSubClosed, err)
+	}
+
+	if peers := psubs[0].ListPeers(""); len(peers) != 0 {
+		t.Fatal("expected no peers after close, got ", peers)
+	}
+}
+
+func TestPublishMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	foo, err := psubs[1].Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bar, err := psubs[2].Subscribe("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	both, err := psubs[2].Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := []byte("one message, many topics")
+	err = psubs[0].PublishMany([]string{"foo", "bar", "foo"}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, foo, msg)
+	assertReceive(t, bar, msg)
+	assertReceive(t, both, msg)
+
+	select {
+	case <-both.ch:
+		t.Fatal("got the same message twice")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	err = psubs[0].PublishMany(nil, msg)
+	if err == nil {
+		t.Fatal("expected an error publishing without topics")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	topic := "foobar"
+
+	err := psubs[1].RegisterTopicValidator(topic, func(pid peer.ID, msg *Message) bool {
+		return !bytes.Contains(msg.GetData(), []byte("illegal"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = psubs[1].RegisterTopicValidator(topic, func(peer.ID, *Message) bool { return true })
+	if err == nil {
+		t.Fatal("expected an error registering a second validator")
+	}
+
+	err = psubs[2].RegisterTopicValidator(topic, nil)
+	if err == nil {
+		t.Fatal("expected an error registering a nil validator")
+	}
+
+	sub1, err := psubs[1].Subscribe(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub2, err := psubs[2].Subscribe(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msgs := []struct {
+		msg       []byte
+		validates bool
+	}{
+		{msg: []byte("this is a legal message"), validates: true},
+		{msg: []byte("there also is nothing controversial about this message"), validates: true},
+		{msg: []byte("openly illegal content will be censored"), validates: false},
+		{msg: []byte("but subversive actors will use leetspeek to spread 1ll3g4l content"), validates: true},
+	}
+
+	for _, tc := range msgs {
+		err := psubs[0].Publish(topic, tc.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, sub := range []*Subscription{sub1, sub2} {
+			select {
+			case msg := <-sub.ch:
+				if !tc.validates {
+					t.Fatal("got message that should have been dropped: ", string(msg.GetData()))
+				}
+				if !bytes.Equal(msg.GetData(), tc.msg) {
+					t.Fatal("got wrong message")
+				}
+			case <-time.After(time.Millisecond * 200):
+				if tc.validates {
+					t.Fatal("did not get message that should have passed validation")
+				}
+			}
+		}
+	}
+
+	err = psubs[1].UnregisterTopicValidator(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = psubs[1].UnregisterTopicValidator(topic)
+	if err == nil {
+		t.Fatal("expected an error removing a missing validator")
+	}
+
+	checkMessageRouting(t, topic, psubs[:1], []*Subscription{sub1, sub2})
+}
+
+func TestMessageCacheDuration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+	psub := getPubsub(ctx, host, WithMessageCacheDuration(time.Millisecond*50))
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{
+		Message: &pb.Message{
+			Data:     []byte("again and again"),
+			TopicIDs: []string{"foobar"},
+			From:     []byte(host.ID()),
+			Seqno:    []byte("00000001"),
+		},
+	}
+
+	psub.publish <- &publishReq{msg: msg}
+	assertReceive(t, sub, msg.GetData())
+
+	// still within the cache window, the duplicate is suppressed
+	psub.publish <- &publishReq{msg: msg}
+	select {
+	case <-sub.ch:
+		t.Fatal("duplicate message was delivered")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	// expired entries are swept when the next message is seen
+	err = psub.Publish("foobar", []byte("sweep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, sub, []byte("sweep"))
+
+	psub.publish <- &publishReq{msg: msg}
+	assertReceive(t, sub, msg.GetData())
+}
+
+func TestInvalidOption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+
+	_, err := NewFloodSub(ctx, host, WithMessageCacheDuration(0))
+	if err == nil {
+		t.Fatal("expected an error for a zero message cache duration")
+	}
+
+	_, err = NewFloodSub(ctx, host, WithPeerDrainTimeout(-time.Second))
+	if err == nil {
+		t.Fatal("expected an error for a negative peer drain timeout")
+	}
+}
+
+func TestMessageOrderPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	for i := 0; i < 20; i++ {
+		err := psubs[0].Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		assertReceive(t, sub, []byte(fmt.Sprint(i)))
+	}
+}
+
+func assertTopicEvent(t *testing.T, evts <-chan TopicEvent, typ TopicEventType, pid peer.ID, topic string) {
+	select {
+	case evt := <-evts:
+		if evt.Type != typ || evt.Peer != pid || evt.Topic != topic {
+			t.Fatalf("expected %s of %s on %s, got %s of %s on %s", typ, pid, topic, evt.Type, evt.Peer, evt.Topic)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for topic event")
+	}
+}
+
+func TestTopicEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	evtCtx, evtCancel := context.WithCancel(ctx)
+	evts, err := psubs[0].SubscribeTopicEvents(evtCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTopicEvent(t, evts, PeerJoin, hosts[1].ID(), "foobar")
+
+	sub.Cancel()
+
+	assertTopicEvent(t, evts, PeerLeave, hosts[1].ID(), "foobar")
+
+	evtCancel()
+
+	select {
+	case _, ok := <-evts:
+		if ok {
+			t.Fatal("got unexpected topic event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event channel to be closed")
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	psubs[1].BlacklistPeer(hosts[0].ID())
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	for _, pid := range psubs[1].ListPeers("") {
+		if pid == hosts[0].ID() {
+			t.Fatal("blacklisted peer is in our peer list")
+		}
+	}
+
+	err = psubs[0].Publish("foobar", []byte("you can't hear me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sub.ch:
+		t.Fatal("got a message from a blacklisted peer")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// blacklisting a connected peer drops it
+	psubs[1].BlacklistPeer(hosts[2].ID())
+	assertPeerLists(t, hosts, psubs[2], 1)
+	if peers := psubs[1].ListPeers(""); len(peers) != 0 {
+		t.Fatal("expected no peers after blacklisting, got ", peers)
+	}
+}
+
+func TestMessageIdFn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts, WithMessageIdFn(func(pmsg *pb.Message) string {
+		return string(pmsg.GetData())
+	}))
+
+	connect(t, hosts[0], hosts[2])
+	connect(t, hosts[1], hosts[2])
+
+	sub, err := psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := []byte("same content, different origins")
+	for _, ps := range psubs[:2] {
+		err := ps.Publish("foobar", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertReceive(t, sub, msg)
+
+	select {
+	case <-sub.ch:
+		t.Fatal("got the same content twice")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	var subs []*Subscription
+	for i := 0; i < 3; i++ {
+		sub, err := psubs[1].Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	peers := psubs[0].ListPeers("foobar")
+	assertPeerList(t, peers, hosts[1].ID())
+
+	err := psubs[1].Unsubscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range subs {
+		_, err := sub.Next(ctx)
+		if err != ErrSubscriptionCancelled {
+			t.Fatalf("expected %v, got %v", ErrSubscriptionCancelled, err)
+		}
+	}
+
+	assertHasTopics(t, psubs[1])
+
+	time.Sleep(time.Millisecond * 50)
+
+	peers = psubs[0].ListPeers("foobar")
+	assertPeerList(t, peers)
+
+	err = psubs[1].Unsubscribe("foobar")
+	if !errors.Is(err, ErrNotSubscribed) {
+		t.Fatalf("expected ErrNotSubscribed unsubscribing from a topic we left, got %v", err)
+	}
+
+	// cancelling a subscription after unsubscribing is a no-op, even with new
+	// subscriptions on the same topic
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs[0].Cancel()
+	assertHasTopics(t, psubs[1], "foobar")
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkMessageRouting(t, "foobar", psubs[:1], []*Subscription{sub})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithMaxMessageSize(1024)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	big := make([]byte, 2048)
+	rand.Read(big)
+
+	err = psubs[1].Publish("foobar", big)
+	if err == nil {
+		t.Fatal("expected an error publishing an oversized message")
+	}
+
+	err = psubs[0].Publish("foobar", big)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sub.ch:
+		t.Fatal("got a message exceeding the maximum size")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPublishAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+
+	psCtx, psCancel := context.WithCancel(ctx)
+	psub := getPubsub(psCtx, host)
+
+	psCancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- psub.Publish("foobar", []byte("anyone there?"))
+	}()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("publish blocked after the context was cancelled")
+	}
+}
+
+func TestSubscriptionNext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+	psub := getPubsub(ctx, host)
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer tcancel()
+
+	_, err = sub.Next(tctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	err = psub.Publish("foobar", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != "hello" {
+		t.Fatal("got wrong message: ", string(msg.GetData()))
+	}
+
+	sub.Cancel()
+
+	_, err = sub.Next(ctx)
+	if err != ErrSubscriptionCancelled {
+		t.Fatalf("expected %v, got %v", ErrSubscriptionCancelled, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	err := psubs[2].RegisterTopicValidator("foobar", func(pid peer.ID, msg *Message) bool {
+		return string(msg.GetData()) != "invalid"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := &Message{
+		Message: &pb.Message{
+			Data:     []byte("valid"),
+			TopicIDs: []string{"foobar"},
+			From:     []byte(hosts[0].ID()),
+			Seqno:    []byte("00000001"),
+		},
+	}
+
+	// publish the same message twice, the second one is a duplicate
+	psubs[0].publish <- &publishReq{msg: msg}
+	psubs[0].publish <- &publishReq{msg: msg}
+
+	for _, sub := range subs {
+		assertReceive(t, sub, msg.GetData())
+	}
+
+	err = psubs[0].Publish("foobar", []byte("invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("invalid"))
+
+	err = psubs[1].Publish("barfoo", []byte("nobody listens"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	s0 := psubs[0].Stats()
+	if s0.Published != 3 || s0.Forwarded != 2 || s0.DroppedSeen != 1 {
+		t.Fatalf("unexpected stats for the publisher: %+v", s0)
+	}
+
+	s1 := psubs[1].Stats()
+	if s1.Published != 1 || s1.Received != 2 || s1.Forwarded != 2 {
+		t.Fatalf("unexpected stats for the first subscriber: %+v", s1)
+	}
+
+	s2 := psubs[2].Stats()
+	if s2.Received != 2 || s2.DroppedValidation != 1 || s2.Forwarded != 0 {
+		t.Fatalf("unexpected stats for the second subscriber: %+v", s2)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	reg := prometheus.NewRegistry()
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithMetricsRegisterer(reg)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkMessageRouting(t, "foobar", psubs[:1], []*Subscription{sub})
+
+	checkMetrics := func(expected map[string]float64) {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := make(map[string]float64)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				switch {
+				case m.GetGauge() != nil:
+					values[mf.GetName()] += m.GetGauge().GetValue()
+				case m.GetCounter() != nil:
+					values[mf.GetName()] += m.GetCounter().GetValue()
+				case m.GetHistogram() != nil:
+					values[mf.GetName()] += float64(m.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+
+		for name, v := range expected {
+			if values[name] != v {
+				t.Fatalf("expected %s to be %v, got %v", name, v, values[name])
+			}
+		}
+
+		// the RPC carrying the message at least
+		if n := values["floodsub_event_loop_duration_seconds"]; n < 1 {
+			t.Fatalf("expected timed events, got %v", n)
+		}
+	}
+
+	checkMetrics(map[string]float64{
+		"floodsub_peers":               1,
+		"floodsub_topics":              1,
+		"floodsub_topic_subscriptions": 1,
+		"floodsub_messages_in_total":   1,
+
+		"floodsub_incoming_queue_capacity": DefaultIncomingQueueSize,
+	})
+
+	_, err = NewFloodSub(ctx, getNetHosts(t, ctx, 1)[0], WithMetricsRegisterer(reg))
+	if err == nil {
+		t.Fatal("expected an error registering metrics twice")
+	}
+
+	psubs[1].Close()
+
+	checkMetrics(map[string]float64{
+		"floodsub_peers":               0,
+		"floodsub_topics":              0,
+		"floodsub_topic_subscriptions": 0,
+		"floodsub_messages_in_total":   1,
+	})
+}
+
+func TestSubscribePrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	relay, err := psubs[1].SubscribePrefix("sensors/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room1, err := psubs[2].SubscribePrefix("sensors/room1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertHasTopics(t, psubs[2], "sensors/room1/*")
+
+	time.Sleep(time.Millisecond * 50)
+
+	temp := []byte("21.5")
+	err = psubs[0].Publish("sensors/room1/temp", temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, relay, temp)
+	assertReceive(t, room1, temp)
+
+	// a message matching the prefix with several topics is delivered once
+	both := []byte("both rooms")
+	err = psubs[0].PublishMany([]string{"sensors/room1/temp", "sensors/room1/humidity", "sensors/room2/temp"}, both)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, relay, both)
+	assertReceive(t, room1, both)
+
+	room2 := []byte("room2 only")
+	err = psubs[0].Publish("sensors/room2/temp", room2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, relay, room2)
+
+	select {
+	case msg := <-room1.ch:
+		t.Fatal("got message for a topic not matching the prefix: ", string(msg.GetData()))
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	room1.Cancel()
+	assertHasTopics(t, psubs[2])
+}
+
+func TestMonotonicSeqno(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+	psub := getPubsub(ctx, host)
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for i := 0; i < 10; i++ {
+		err := psub.Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(msg.GetSeqno()) != 8 {
+			t.Fatalf("expected an 8 byte seqno, got %d bytes", len(msg.GetSeqno()))
+		}
+
+		seqno := binary.BigEndian.Uint64(msg.GetSeqno())
+		if i > 0 && seqno != last+1 {
+			t.Fatalf("expected seqno %d, got %d", last+1, seqno)
+		}
+		last = seqno
+	}
+}
+
+func TestProtocolID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithProtocolID("/myapp/floodsub/1.0.0")),
+		getPubsub(ctx, hosts[1], WithProtocolID("/myapp/floodsub/1.0.0")),
+		getPubsub(ctx, hosts[2]),
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	time.Sleep(time.Millisecond * 50)
+
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID())
+	assertPeerList(t, psubs[2].ListPeers(""))
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkMessageRouting(t, "foobar", psubs[:1], []*Subscription{sub})
+}
+
+func TestMultipleProtocolIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const v11 = protocol.ID("/floodsub/1.1.0")
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithProtocolIDs(v11, ID)),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2], WithProtocolID(v11)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+	connect(t, hosts[1], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID(), hosts[2].ID())
+	assertPeerList(t, psubs[1].ListPeers(""), hosts[0].ID())
+	assertPeerList(t, psubs[2].ListPeers(""), hosts[0].ID())
+
+	checkMessageRouting(t, "foobar", psubs, subs)
+}
+
+func TestPublishTo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:3] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// hosts[3] is not connected and silently skipped
+	msg := []byte("just for you")
+	err := psubs[0].PublishTo([]peer.ID{hosts[2].ID(), hosts[3].ID()}, "foobar", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[1], msg)
+
+	select {
+	case <-subs[0].ch:
+		t.Fatal("got a message meant for another peer")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPublishWithTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	connect(t, hosts[2], hosts[3])
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := []byte("not too far")
+	err := psubs[0].PublishWithTTL("foobar", msg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[0], msg)
+	assertReceive(t, subs[1], msg)
+
+	select {
+	case <-subs[2].ch:
+		t.Fatal("message travelled further than its TTL")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// messages without TTL are not limited
+	checkMessageRouting(t, "foobar", psubs[:1], subs)
+}
+
+func TestPeerCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	if n := psubs[0].PeerCount(); n != 0 {
+		t.Fatalf("expected no peers, got %d", n)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	time.Sleep(time.Millisecond * 50)
+
+	if n := psubs[0].PeerCount(); n != 2 {
+		t.Fatalf("expected 2 peers, got %d", n)
+	}
+
+	psubs[0].BlacklistPeer(hosts[2].ID())
+
+	time.Sleep(time.Millisecond * 50)
+
+	if n := psubs[0].PeerCount(); n != 1 {
+		t.Fatalf("expected 1 peer, got %d", n)
+	}
+
+	psubs[0].Close()
+
+	if n := psubs[0].PeerCount(); n != 0 {
+		t.Fatalf("expected no peers after Close, got %d", n)
+	}
+}
+
+func TestDuplicateStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// pretend the peers dialed each other and we got a second stream
+	s, err := hosts[0].NewStream(ctx, hosts[1].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psubs[0].newPeers <- s
+
+	for i := 0; i < 10; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		if err := psubs[0].Publish("foobar", msg); err != nil {
+			t.Fatal(err)
+		}
+		assertReceive(t, sub, msg)
+	}
+
+	if n := psubs[0].PeerCount(); n != 1 {
+		t.Fatalf("expected 1 peer, got %d", n)
+	}
+
+	// the redundant stream must have been closed
+	s.SetDeadline(time.Now().Add(time.Second))
+	if _, err := s.Write([]byte{0}); err == nil {
+		t.Fatal("expected the duplicate stream to be closed")
+	}
+}
+
+func TestDeliveryPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	newest, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldest, err := psub.Subscribe("foobar", WithDeliveryPolicy(DropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := psub.Subscribe("foobar", WithDeliveryPolicy(BlockWithTimeout), WithDeliveryTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = psub.Subscribe("foobar", WithDeliveryPolicy(DeliveryPolicy(42)))
+	if err == nil {
+		t.Fatal("expected an error for an unknown delivery policy")
+	}
+
+	const count = 40
+	var received []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			msg, err := block.Next(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			received = append(received, string(msg.Data))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		err := psub.Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-done
+	if len(received) != count {
+		t.Fatalf("expected %d messages with BlockWithTimeout, got %d", count, len(received))
+	}
+
+	for i := 0; i < 32; i++ {
+		assertReceive(t, newest, []byte(fmt.Sprint(i)))
+		assertReceive(t, oldest, []byte(fmt.Sprint(count-32+i)))
+	}
+
+	if n := psub.Stats().DroppedSubscriberFull; n != 2*(count-32) {
+		t.Fatalf("expected %d dropped deliveries, got %d", 2*(count-32), n)
+	}
+}
+
+func TestSubscriptionBufferSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	small, err := psub.Subscribe("foobar", WithBufferSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large, err := psub.Subscribe("foobar", WithBufferSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{-1, 0} {
+		_, err = psub.Subscribe("foobar", WithBufferSize(n))
+		if err == nil {
+			t.Fatalf("expected an error for a buffer size of %d", n)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		err := psub.Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if n := len(small.ch); n != 4 {
+		t.Fatalf("expected 4 buffered messages, got %d", n)
+	}
+	if n := len(large.ch); n != 50 {
+		t.Fatalf("expected 50 buffered messages, got %d", n)
+	}
+}
+
+func TestPeerEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	evts, err := psubs[0].SubscribePeerEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertPeerEvent := func(typ PeerEventType) {
+		select {
+		case evt := <-evts:
+			if evt.Type != typ || evt.Peer != hosts[1].ID() {
+				t.Fatalf("expected %s of %s, got %s of %s", typ, hosts[1].ID(), evt.Type, evt.Peer)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for peer event")
+		}
+	}
+
+	connect(t, hosts[0], hosts[1])
+	assertPeerEvent(PeerConnected)
+
+	psubs[0].BlacklistPeer(hosts[1].ID())
+	assertPeerEvent(PeerDisconnected)
+
+	psubs[0].Close()
+
+	select {
+	case _, ok := <-evts:
+		if ok {
+			t.Fatal("got unexpected peer event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event channel to be closed")
+	}
+}
+
+// rawRPCs registers a floodsub stream handler on h which doesn't run a
+// PubSub, and returns the RPCs it reads
+func rawRPCs(h host.Host) <-chan *pb.RPC {
+	out := make(chan *pb.RPC, 32)
+	h.SetStreamHandler(ID, func(s inet.Stream) {
+		defer s.Close()
+		r := ggio.NewDelimitedReader(s, DefaultMaxMessageSize)
+		for {
+			rpc := new(pb.RPC)
+			if err := r.ReadMsg(rpc); err != nil {
+				return
+			}
+			out <- rpc
+		}
+	})
+	return out
+}
+
+func nextRPC(t *testing.T, rpcs <-chan *pb.RPC) *pb.RPC {
+	select {
+	case rpc := <-rpcs:
+		return rpc
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for rpc")
+		return nil
+	}
+}
+
+func TestAnnounceBatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithAnnounceBatching(time.Millisecond*50))
+	rpcs := rawRPCs(hosts[1])
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 50)
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		_, err := psub.Subscribe(fmt.Sprintf("topic%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subs := nextRPC(t, rpcs).GetSubscriptions()
+	if len(subs) != count {
+		t.Fatalf("expected %d subscriptions in a single rpc, got %d", count, len(subs))
+	}
+	for _, so := range subs {
+		if !so.GetSubscribe() {
+			t.Fatalf("expected a subscription to %s, got an unsubscription", so.GetTopicid())
+		}
+	}
+}
+
+func TestAnnounceBatchingLatestWins(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithAnnounceBatching(time.Millisecond*50))
+	rpcs := rawRPCs(hosts[1])
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 50)
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Cancel()
+
+	subs := nextRPC(t, rpcs).GetSubscriptions()
+	if len(subs) != 1 {
+		t.Fatalf("expected a single subscription change, got %d", len(subs))
+	}
+	if subs[0].GetTopicid() != "foobar" || subs[0].GetSubscribe() {
+		t.Fatalf("expected to unsubscribe from foobar, got %s", subs[0])
+	}
+}
+
+func TestAnnounceNotDropped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0])
+
+	// a peer which subscribes to foobar but doesn't read until released
+	release := make(chan struct{})
+	rpcs := make(chan *pb.RPC, 100)
+	hosts[1].SetStreamHandler(ID, func(s inet.Stream) {
+		defer s.Close()
+		<-release
+		r := ggio.NewDelimitedReader(s, DefaultMaxMessageSize)
+		for {
+			rpc := new(pb.RPC)
+			if err := r.ReadMsg(rpc); err != nil {
+				return
+			}
+			rpcs <- rpc
+		}
+	})
+
+	connect(t, hosts[0], hosts[1])
+
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&rpcWithSubs(&pb.RPC_SubOpts{
+		Topicid:   proto.String("foobar"),
+		Subscribe: proto.Bool(true),
+	}).RPC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// overflow the message queue to the peer
+	for i := 0; i < peerOutboundQueueSize*2; i++ {
+		err := psub.Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = psub.Subscribe("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	if psub.Stats().DroppedQueueFull == 0 {
+		t.Fatal("expected the message queue to overflow")
+	}
+	close(release)
+
+	for {
+		rpc := nextRPC(t, rpcs)
+		for _, so := range rpc.GetSubscriptions() {
+			if so.GetTopicid() == "baz" && so.GetSubscribe() {
+				return
+			}
+		}
+	}
+}
+
+func TestPublishWithTTLMaxSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0], WithMaxMessageSize(256))
+
+	// find the largest payload we may publish without TTL
+	n := 0
+	for psub.Publish("foobar", make([]byte, n+1)) == nil {
+		n++
+	}
+
+	err := psub.PublishWithTTL("foobar", make([]byte, n), 1)
+	if err == nil {
+		t.Fatal("expected the TTL to count towards the maximum message size")
+	}
+}
+
+func TestHelloPacketLateJoiner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	// subscribe before the peers know about each other
+	var subs []*Subscription
+	for _, topic := range []string{"foo", "bar"} {
+		sub, err := psubs[0].Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(time.Millisecond * 50)
+
+	for i, topic := range []string{"foo", "bar"} {
+		peers := psubs[1].ListPeers(topic)
+		if len(peers) != 1 || peers[0] != hosts[0].ID() {
+			t.Fatalf("expected %s to know we are on %s, got %v", hosts[1].ID(), topic, peers)
+		}
+
+		checkMessageRouting(t, topic, psubs[1:], subs[i:i+1])
+	}
+}
+
+func TestPeerDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithPeerDrainTimeout(time.Millisecond*50))
+
+	// a peer which subscribes to foobar but never reads
+	stalled := make(chan struct{})
+	defer close(stalled)
+	hosts[1].SetStreamHandler(ID, func(s inet.Stream) {
+		<-stalled
+	})
+
+	connect(t, hosts[0], hosts[1])
+
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&rpcWithSubs(&pb.RPC_SubOpts{
+		Topicid:   proto.String("foobar"),
+		Subscribe: proto.Bool(true),
+	}).RPC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		err := psub.Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	psub.BlacklistPeer(hosts[1].ID())
+	time.Sleep(time.Millisecond * 200)
+
+	if n := psub.Stats().DroppedPeerGone; n != count {
+		t.Fatalf("expected %d messages dropped with the peer, got %d", count, n)
+	}
+}
+
+func TestPeerTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	for _, topic := range []string{"foo", "bar", "baz"} {
+		_, err := psubs[1].Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := psubs[1].Unsubscribe("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	topics := psubs[0].PeerTopics(hosts[1].ID())
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "bar" || topics[1] != "foo" {
+		t.Fatalf("expected [bar foo], got %v", topics)
+	}
+
+	if topics := psubs[0].PeerTopics(hosts[0].ID()); len(topics) != 0 {
+		t.Fatalf("expected no topics for an unknown peer, got %v", topics)
+	}
+}
+
+func TestSubscribeCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	sub, err := psub.SubscribeCtx(ctx, "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessageRouting(t, "foobar", []*PubSub{psub}, []*Subscription{sub})
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	subCancel()
+
+	// keep the event loop busy so it can't take the subscription
+	block := make(chan struct{})
+	defer close(block)
+	err = psub.RegisterTopicValidator("blocking", func(peer.ID, *Message) bool {
+		<-block
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = psub.Publish("blocking", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = psub.SubscribeCtx(subCtx, "baz")
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithPeerRateLimit(0.1, 5), WithRateLimitBlacklist(10)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	for i := 0; i < 10; i++ {
+		err := psubs[0].Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		assertReceive(t, sub, []byte(fmt.Sprint(i)))
+	}
+
+	select {
+	case <-sub.ch:
+		t.Fatal("got a message beyond the rate limit")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := psubs[1].Stats().DroppedRateLimited; n != 5 {
+		t.Fatalf("expected 5 rate limited messages, got %d", n)
+	}
+
+	if peers := psubs[1].ListPeers(""); len(peers) != 1 {
+		t.Fatalf("expected the peer to be kept below the blacklist threshold, got %v", peers)
+	}
+
+	for i := 0; i < 5; i++ {
+		err := psubs[0].Publish("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if peers := psubs[1].ListPeers(""); len(peers) != 0 {
+		t.Fatalf("expected the peer to be blacklisted, got %v", peers)
+	}
+
+	_, err = NewFloodSub(ctx, getNetHosts(t, ctx, 1)[0], WithPeerRateLimit(0, 1))
+	if err == nil {
+		t.Fatal("expected an error for a zero rate limit")
+	}
+}
+
+func TestContentDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2], WithContentDedup(time.Minute)),
+	}
+
+	connect(t, hosts[0], hosts[2])
+	connect(t, hosts[1], hosts[2])
+
+	sub, err := psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := []byte("same old news")
+	for _, ps := range psubs[:2] {
+		err := ps.Publish("foobar", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertReceive(t, sub, msg)
+
+	select {
+	case <-sub.ch:
+		t.Fatal("got the same content twice")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := psubs[2].Stats().DroppedContentDup; n != 1 {
+		t.Fatalf("expected 1 content duplicate, got %d", n)
+	}
+
+	// the same data on another topic is different content
+	if ContentMsgIdFn(&pb.Message{TopicIDs: []string{"foobar"}, Data: msg}) ==
+		ContentMsgIdFn(&pb.Message{TopicIDs: []string{"baz"}, Data: msg}) {
+		t.Fatal("expected content IDs to depend on the topics")
+	}
+}
+
+func TestMaxTopicsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithMaxTopicsPerPeer(2)),
+		getPubsub(ctx, hosts[1]),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	subs := make(map[string]*Subscription)
+	for _, topic := range []string{"a", "b", "c"} {
+		sub, err := psubs[1].Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs[topic] = sub
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if n := len(psubs[0].PeerTopics(hosts[1].ID())); n != 2 {
+		t.Fatalf("expected 2 tracked topics, got %d", n)
+	}
+	if n := psubs[0].Stats().RejectedSubscriptions; n != 1 {
+		t.Fatalf("expected 1 rejected subscription, got %d", n)
+	}
+
+	// leaving a topic makes room for another one
+	subs["a"].Cancel()
+	time.Sleep(time.Millisecond * 50)
+
+	if _, err := psubs[1].Subscribe("d"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	topics := psubs[0].PeerTopics(hosts[1].ID())
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "b" || topics[1] != "d" {
+		t.Fatalf("expected [b d], got %v", topics)
+	}
+}
+
+func TestIsSubscribed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	if psub.IsSubscribed("foobar") {
+		t.Fatal("expected not to be subscribed yet")
+	}
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !psub.IsSubscribed("foobar") {
+		t.Fatal("expected to be subscribed")
+	}
+
+	sub.Cancel()
+
+	if psub.IsSubscribed("foobar") {
+		t.Fatal("expected not to be subscribed after cancelling")
+	}
+
+	psub.Close()
+
+	if psub.IsSubscribed("foobar") {
+		t.Fatal("expected not to be subscribed after Close")
+	}
+}
+
+func TestMatchedTopic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	exact, err := psub.Subscribe("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix, err := psub.SubscribePrefix("sensors/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = psub.PublishMany([]string{"foo", "bar", "sensors/temp"}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sub, topic := range map[*Subscription]string{exact: "bar", prefix: "sensors/temp"} {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MatchedTopic != topic {
+			t.Fatalf("expected the message to match %s, got %s", topic, msg.MatchedTopic)
+		}
+	}
+}
+
+func TestIncomingQueueSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithIncomingQueueSize(256)),
+		getPubsub(ctx, hosts[1], WithIncomingQueueSize(0)),
+		getPubsub(ctx, hosts[2]),
+	}
+
+	if n := cap(psubs[0].incoming); n != 256 {
+		t.Fatalf("expected an incoming queue of 256, got %d", n)
+	}
+	if n := cap(psubs[2].incoming); n != DefaultIncomingQueueSize {
+		t.Fatalf("expected an incoming queue of %d, got %d", DefaultIncomingQueueSize, n)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkMessageRouting(t, "foobar", psubs, subs)
+
+	_, err := NewFloodSub(ctx, getNetHosts(t, ctx, 1)[0], WithIncomingQueueSize(-1))
+	if err == nil {
+		t.Fatal("expected an error for a negative incoming queue size")
+	}
+}
+
+// xorCipher is a toy TopicCipher, failing on data it didn't encrypt
+type xorCipher byte
+
+func (c xorCipher) Encrypt(data []byte) ([]byte, error) {
+	out := []byte{'x'}
+	for _, b := range data {
+		out = append(out, b^byte(c))
+	}
+	return out, nil
+}
+
+func (c xorCipher) Decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'x' {
+		return nil, fmt.Errorf("not encrypted")
+	}
+
+	var out []byte
+	for _, b := range data[1:] {
+		out = append(out, b^byte(c))
+	}
+	return out, nil
+}
+
+func TestTopicCipher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithTopicCipher("secret", xorCipher(42))),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2], WithTopicCipher("secret", xorCipher(42))),
+		getPubsub(ctx, hosts[3], WithTopicCipher("secret", xorCipher(42))),
+	}
+
+	// the relay in the middle doesn't have the cipher
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	connect(t, hosts[1], hosts[3])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	msg := []byte("attack at dawn")
+	err := psubs[0].Publish("secret", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[0], msg)
+	assertReceive(t, subs[2], msg)
+	assertReceive(t, subs[3], msg)
+
+	ciphertext, _ := xorCipher(42).Encrypt(msg)
+	assertReceive(t, subs[1], ciphertext)
+
+	// plaintext published by the relay can't be decrypted
+	err = psubs[1].Publish("secret", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[1], msg)
+	for _, i := range []int{0, 2, 3} {
+		select {
+		case m := <-subs[i].ch:
+			t.Fatalf("peer %d got undecryptable message: %s", i, m.GetData())
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		if n := psubs[i].Stats().DroppedDecryption; n != 1 {
+			t.Fatalf("expected peer %d to drop 1 message, got %d", i, n)
+		}
+	}
+
+	err = psubs[0].PublishMany([]string{"secret", "public"}, msg)
+	if err == nil {
+		t.Fatal("expected error publishing to an encrypted and another topic")
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithTopicCipher("secret", nil))
+	if err == nil {
+		t.Fatal("expected error for nil cipher")
+	}
+}
+
+func TestPublishValidated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	calls := 0
+	err := psubs[0].RegisterTopicValidator("foobar", func(pid peer.ID, msg *Message) bool {
+		calls++
+		return !bytes.Contains(msg.GetData(), []byte("illegal"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	err = psubs[0].PublishValidated("foobar", []byte("illegal content"))
+	if err != ErrValidationFailed {
+		t.Fatalf("expected ErrValidationFailed, got %v", err)
+	}
+
+	err = psubs[0].PublishValidated("foobar", []byte("fine content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected the validator to run twice, ran %d times", calls)
+	}
+
+	assertReceive(t, sub, []byte("fine content"))
+
+	select {
+	case m := <-sub.ch:
+		t.Fatalf("got message failing validation: %s", m.GetData())
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// topics without validator always pass
+	err = psubs[0].PublishValidated("other", []byte("illegal content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceivedAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	before := time.Now()
+	err := psubs[0].Publish("foobar", []byte("tick"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sub := range subs {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.ReceivedAt.Before(before) || msg.ReceivedAt.After(time.Now()) {
+			t.Fatalf("peer %d got bad receive time %s, published at %s", i, msg.ReceivedAt, before)
+		}
+	}
+}
+
+func TestDirectPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithDirectPeers([]pstore.PeerInfo{{ID: hosts[1].ID()}})),
+		getPubsub(ctx, hosts[1], WithDirectPeers([]pstore.PeerInfo{{ID: hosts[0].ID()}})),
+	}
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// we never connected the hosts ourselves
+	time.Sleep(time.Millisecond * 100)
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID())
+
+	err = psubs[0].Publish("foobar", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, sub, []byte("hello"))
+
+	// a second stream replaces the session instead of being dropped
+	s, err := hosts[0].NewStream(ctx, hosts[1].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psubs[0].newPeers <- s
+
+	time.Sleep(time.Millisecond * 50)
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID())
+
+	err = psubs[0].Publish("foobar", []byte("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, sub, []byte("replaced"))
+
+	// break the connection, the failed write makes us dial again
+	hosts[1].Network().ClosePeer(hosts[0].ID())
+	time.Sleep(time.Millisecond * 50)
+
+	err = psubs[0].Publish("foobar", []byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(directPeerRetryInterval + time.Millisecond*200)
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID())
+
+	err = psubs[0].Publish("foobar", []byte("back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, sub, []byte("back"))
+
+	_, err = NewFloodSub(ctx, hosts[0], WithDirectPeers([]pstore.PeerInfo{{}}))
+	if err == nil {
+		t.Fatal("expected error for direct peer without ID")
+	}
+}
+
+func TestReconnectStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts, WithReconnectBackoff(3, time.Millisecond*20))
+
+	connect(t, hosts[0], hosts[1])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// reset the streams, keeping the connection
+	for _, s := range hosts[0].Network().ConnsToPeer(hosts[1].ID())[0].GetStreams() {
+		s.Close()
+	}
+
+	// the failing writes make both sides reopen their stream
+	for _, ps := range psubs {
+		err := ps.Publish("foobar", []byte("lost"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range subs {
+		assertReceive(t, sub, []byte("lost"))
+	}
+
+	time.Sleep(time.Millisecond * 200)
+
+	for i, ps := range psubs {
+		assertPeerList(t, ps.ListPeers("foobar"), hosts[1-i].ID())
+	}
+
+	// the new streams started with our subscriptions
+	err := psubs[0].Publish("foobar", []byte("back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("back"))
+	assertReceive(t, subs[1], []byte("back"))
+
+	_, err = NewFloodSub(ctx, hosts[0], WithReconnectBackoff(-1, time.Second))
+	if err == nil {
+		t.Fatal("expected error for negative reconnect attempts")
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts, WithMaxMessageSize(1<<10))
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	var payloads [][]byte
+	for i := 0; i < 10; i++ {
+		payloads = append(payloads, []byte(fmt.Sprint("message ", i)))
+	}
+
+	err = psubs[0].PublishBatch("foobar", payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for i, data := range payloads {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(msg.GetData(), data) {
+			t.Fatalf("expected %q, got %q", data, msg.GetData())
+		}
+
+		seqno := binary.BigEndian.Uint64(msg.GetSeqno())
+		if i > 0 && seqno != last+1 {
+			t.Fatalf("expected seqno %d, got %d", last+1, seqno)
+		}
+		last = seqno
+	}
+
+	if n := psubs[0].Stats().Published; n != 10 {
+		t.Fatalf("expected 10 published messages, got %d", n)
+	}
+
+	// one oversized payload fails the whole batch
+	err = psubs[0].PublishBatch("foobar", [][]byte{[]byte("small"), make([]byte, 1<<10)})
+	if err == nil {
+		t.Fatal("expected error for oversized payload")
+	}
+
+	select {
+	case m := <-sub.ch:
+		t.Fatalf("got message of failed batch: %s", m.GetData())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// benchPubsub returns a PubSub publishing to a single subscribed peer
+func benchPubsub(b *testing.B, ctx context.Context, opts ...Option) *PubSub {
+	// GenSwarmNetwork only uses the T to report setup failures
+	hosts := getNetHosts(new(testing.T), ctx, 2)
+	psubs := getPubsubs(ctx, hosts, opts...)
+
+	err := hosts[0].Connect(ctx, hosts[1].Peerstore().PeerInfo(hosts[1].ID()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	_, err = psubs[1].Subscribe("foobar")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	return psubs[0]
+}
+
+func BenchmarkPublish(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps := benchPubsub(b, ctx)
+	data := []byte("benchmark payload")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ps.Publish("foobar", data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishBatch(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps := benchPubsub(b, ctx)
+	payloads := make([][]byte, 100)
+	for i := range payloads {
+		payloads[i] = []byte("benchmark payload")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(payloads) {
+		err := ps.PublishBatch("foobar", payloads)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// jsonPayload returns a text heavy payload of about n bytes
+func jsonPayload(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, `{"level":"info","seq":%d,"msg":"request handled","status":200}`+"\n", i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkPublishCompressed(b *testing.B) {
+	data := jsonPayload(4096)
+	for _, c := range []Codec{nil, GzipCodec} {
+		name := "none"
+		var opts []Option
+		if c != nil {
+			name = c.Name()
+			opts = append(opts, WithCompression(c))
+		}
+
+		b.Run(name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ps := benchPubsub(b, ctx, opts...)
+			msg, err := ps.newMessage([]string{"foobar"}, data, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := ps.Publish("foobar", data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(proto.Size(msg.Message)), "wire-bytes/msg")
+		})
+	}
+}
+
+func TestMaxConcurrentSends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithMaxConcurrentSends(1)),
+		getPubsub(ctx, hosts[1]),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a subscribed peer which accepts our stream but doesn't read from it
+	stalled := make(chan struct{})
+	hosts[2].SetStreamHandler(ID, func(s inet.Stream) {
+		<-stalled
+		s.Close()
+	})
+	connect(t, hosts[0], hosts[2])
+
+	s, err := hosts[2].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{
+		Subscriptions: []*pb.RPC_SubOpts{{Topicid: proto.String("foobar"), Subscribe: proto.Bool(true)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	// the write to the stalled peer holds the only slot
+	for _, data := range []string{"one", "two"} {
+		err := psubs[0].Publish("foobar", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	got := 0
+	for done := false; !done; {
+		select {
+		case <-sub.ch:
+			got++
+		case <-time.After(time.Millisecond * 100):
+			done = true
+		}
+	}
+	if got == 2 {
+		t.Fatal("expected sends to wait for the stalled peer")
+	}
+
+	if n := psubs[0].Stats().ThrottledSends; n == 0 {
+		t.Fatal("expected throttled sends")
+	}
+
+	// once the stalled write fails, the other sends go through
+	close(stalled)
+	nctx, ncancel := context.WithTimeout(ctx, time.Second*5)
+	defer ncancel()
+	for ; got < 2; got++ {
+		_, err := sub.Next(nctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithMaxConcurrentSends(0))
+	if err == nil {
+		t.Fatal("expected error for 0 concurrent sends")
+	}
+}
+
+// mapSeenCache is a SeenCache that never forgets
+type mapSeenCache map[string]struct{}
+
+func (c mapSeenCache) Has(id string) bool { _, ok := c[id]; return ok }
+func (c mapSeenCache) Add(id string)      { c[id] = struct{}{} }
+
+func TestSeenCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	cache := make(mapSeenCache)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithSeenCache(cache)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	err = psubs[0].Publish("foobar", []byte("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted node using the same cache still knows the message
+	psubs[1].Close()
+	ps := getPubsub(ctx, hosts[1], WithSeenCache(cache))
+	sub, err = ps.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := hosts[2].NewStream(ctx, hosts[1].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: []*pb.Message{msg.Message}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-sub.ch:
+		t.Fatalf("got message seen before the restart: %s", m.GetData())
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := ps.Stats().DroppedSeen; n != 1 {
+		t.Fatalf("expected 1 seen message, got %d", n)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithSeenCache(nil))
+	if err == nil {
+		t.Fatal("expected error for nil seen cache")
+	}
+}
+
+func TestSeenCacheSize(t *testing.T) {
+	c := newLRUSeenCache(2)
+	c.Add("a")
+	c.Add("b")
+
+	// seeing a again makes b the least recently seen
+	if !c.Has("a") {
+		t.Fatal("expected a to be seen")
+	}
+	c.Add("c")
+
+	for id, seen := range map[string]bool{"a": true, "b": false, "c": true} {
+		if c.Has(id) != seen {
+			t.Fatalf("expected seen(%s) to be %t", id, seen)
+		}
+	}
+	if len(c.ids) != 2 || c.order.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d and %d", len(c.ids), c.order.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithSeenCacheSize(1)),
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	rpcs := make([]*pb.RPC, 0, 2)
+	for _, data := range []string{"first", "second"} {
+		err := psubs[0].Publish("foobar", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpcs = append(rpcs, &pb.RPC{Publish: []*pb.Message{msg.Message}})
+	}
+
+	// the second message evicted the first, so only the second is still
+	// recognized
+	s, err := hosts[0].NewStream(ctx, hosts[1].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := ggio.NewDelimitedWriter(s)
+	for _, rpc := range []*pb.RPC{rpcs[1], rpcs[0]} {
+		err := w.WriteMsg(rpc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertReceive(t, sub, []byte("first"))
+
+	if n := psubs[1].Stats().DroppedSeen; n != 1 {
+		t.Fatalf("expected 1 seen message, got %d", n)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithSeenCacheSize(0))
+	if err == nil {
+		t.Fatal("expected error for empty seen cache")
+	}
+}
+
+func TestPublishCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	_, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkCount := func(topic string, exp int) {
+		n, err := psubs[0].PublishCount(topic, []byte("count me"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != exp {
+			t.Fatalf("expected message on %s to reach %d peers, got %d", topic, exp, n)
+		}
+	}
+
+	checkCount("foobar", 1)
+	checkCount("nobody", 0)
+
+	_, err = psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	checkCount("foobar", 2)
+}
+
+func TestForwardPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+
+	// forward to a single candidate, and try to sneak in the sender
+	var calls int32
+	policy := func(msg *Message, candidates []peer.ID) []peer.ID {
+		atomic.AddInt32(&calls, 1)
+		if len(candidates) != 3 {
+			t.Errorf("expected 3 candidates, got %d", len(candidates))
+		}
+		return []peer.ID{candidates[0], candidates[0], hosts[0].ID()}
+	}
+
+	psubs := []*PubSub{getPubsub(ctx, hosts[0], WithForwardPolicy(policy))}
+	psubs = append(psubs, getPubsubs(ctx, hosts[1:])...)
+
+	var subs []*Subscription
+	for _, h := range hosts[1:] {
+		connect(t, hosts[0], h)
+	}
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	n, err := psubs[0].PublishCount("foobar", []byte("just one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the message to reach 1 peer, got %d", n)
+	}
+
+	got := 0
+	for _, sub := range subs {
+		select {
+		case <-sub.ch:
+			got++
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	if got != 1 {
+		t.Fatalf("expected 1 peer to get the message, got %d", got)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected 1 policy call, got %d", n)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithFragmentation(10)),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2], WithFragmentation(10), WithFragmentTimeout(time.Millisecond*100)),
+	}
+
+	// the node in the middle relays the fragments without reassembling
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	data := []byte("this message is split into five fragments")
+	err := psubs[0].Publish("foobar", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[1], data)
+
+	var relayed []*pb.Message
+	for i := 0; i < 5; i++ {
+		msg, err := subs[0].Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetFragmentIndex() != uint32(i) || msg.GetFragmentCount() != 5 {
+			t.Fatalf("expected fragment %d of 5, got %d of %d", i, msg.GetFragmentIndex(), msg.GetFragmentCount())
+		}
+		relayed = append(relayed, msg.Message)
+	}
+
+	// an incomplete message expires
+	s, err := hosts[3].NewStream(ctx, hosts[2].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	partial := *relayed[0]
+	partial.FragmentGroup = []byte("another group")
+	partial.Seqno = []byte("partial1")
+	invalid := *relayed[1]
+	invalid.Seqno = []byte("invalid1")
+	invalid.FragmentIndex = proto.Uint32(5)
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: []*pb.Message{&partial, &invalid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 300)
+
+	select {
+	case m := <-subs[1].ch:
+		t.Fatalf("got incomplete message: %s", m.GetData())
+	default:
+	}
+
+	if n := psubs[2].Stats().DroppedFragments; n != 2 {
+		t.Fatalf("expected 2 dropped fragments, got %d", n)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithFragmentation(0))
+	if err == nil {
+		t.Fatal("expected error for empty fragments")
+	}
+}
+
+func TestTopicPublishRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+	psub := getPubsub(ctx, host,
+		WithTopicPublishRate("reject", 1, 2, RejectOverRate),
+		WithTopicPublishRate("block", 20, 1, BlockOverRate),
+	)
+
+	sub, err := psub.Subscribe("reject")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := psub.Publish("reject", []byte("burst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = psub.Publish("reject", []byte("too fast"))
+	if err != ErrPublishRateExceeded {
+		t.Fatalf("expected ErrPublishRateExceeded, got %v", err)
+	}
+
+	err = psub.PublishMany([]string{"other", "reject"}, []byte("too fast"))
+	if err != ErrPublishRateExceeded {
+		t.Fatalf("expected ErrPublishRateExceeded, got %v", err)
+	}
+
+	err = psub.Publish("other", []byte("unlimited"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := psub.Publish("block", []byte("waits"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < time.Millisecond*90 {
+		t.Fatalf("expected publishing 3 messages at 20/s to take 100ms, took %s", d)
+	}
+
+	// unsubscribing resets the budget
+	sub.Cancel()
+	time.Sleep(time.Millisecond * 10)
+
+	err = psub.Publish("reject", []byte("fresh budget"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFloodSub(ctx, host, WithTopicPublishRate("foobar", 0, 1, RejectOverRate))
+	if err == nil {
+		t.Fatal("expected error for zero publish rate")
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithOrderedDelivery(time.Millisecond*100))
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := ggio.NewDelimitedWriter(s)
+	send := func(seqnos ...uint64) {
+		rpc := new(pb.RPC)
+		for _, n := range seqnos {
+			seqno := make([]byte, 8)
+			binary.BigEndian.PutUint64(seqno, n)
+			rpc.Publish = append(rpc.Publish, &pb.Message{
+				From:     []byte(hosts[1].ID()),
+				Data:     []byte(fmt.Sprint(n)),
+				Seqno:    seqno,
+				TopicIDs: []string{"foobar"},
+			})
+		}
+
+		err := w.WriteMsg(rpc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(seqnos ...uint64) {
+		for _, n := range seqnos {
+			assertReceive(t, sub, []byte(fmt.Sprint(n)))
+		}
+
+		select {
+		case m := <-sub.ch:
+			t.Fatalf("got unexpected message %s", m.GetData())
+		case <-time.After(time.Millisecond * 150):
+		}
+	}
+
+	// the first messages of an origin wait for the window
+	send(5, 7, 6)
+	select {
+	case m := <-sub.ch:
+		t.Fatalf("got message %s before the window passed", m.GetData())
+	case <-time.After(time.Millisecond * 50):
+	}
+	expect(5, 6, 7)
+
+	// the next message in sequence is delivered right away, those after it
+	// wait for the gap to be filled
+	send(8, 10, 11)
+	assertReceive(t, sub, []byte("8"))
+	send(9)
+	expect(9, 10, 11)
+
+	// gaps are given up on after the window, late messages are dropped
+	send(13, 4)
+	expect(13)
+	send(12)
+	expect()
+
+	if n := psub.Stats().DroppedOutOfOrder; n != 2 {
+		t.Fatalf("expected 2 messages out of order, got %d", n)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithOrderedDelivery(0))
+	if err == nil {
+		t.Fatal("expected error for zero ordering window")
+	}
+}
+
+func TestTopicPeerCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+	// too far away to be counted
+	connect(t, hosts[2], hosts[3])
+
+	for _, ps := range psubs[1:] {
+		_, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := psubs[1].Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	for topic, exp := range map[string]int{"foobar": 2, "other": 1, "nobody": 0} {
+		if n := psubs[0].TopicPeerCount(topic); n != exp {
+			t.Fatalf("expected %d peers on %s, got %d", exp, topic, n)
+		}
+	}
+
+	sub.Cancel()
+	time.Sleep(time.Millisecond * 50)
+
+	if n := psubs[0].TopicPeerCount("other"); n != 0 {
+		t.Fatalf("expected no peers on other, got %d", n)
+	}
+
+	psubs[0].Close()
+	if n := psubs[0].TopicPeerCount("foobar"); n != 0 {
+		t.Fatalf("expected no peers after close, got %d", n)
+	}
+}
+
+func TestPublishIfSubscribers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	connect(t, hosts[0], hosts[1])
+
+	checkPublished := func(topic string, exp bool) {
+		ok, err := psubs[0].PublishIfSubscribers(topic, []byte("telemetry"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != exp {
+			t.Fatalf("expected published to be %t for %s, got %t", exp, topic, ok)
+		}
+	}
+
+	checkPublished("foobar", false)
+	if n := psubs[0].Stats().Published; n != 0 {
+		t.Fatalf("expected no published messages, got %d", n)
+	}
+
+	// a remote subscriber
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	checkPublished("foobar", true)
+	assertReceive(t, sub, []byte("telemetry"))
+
+	// a remote prefix subscriber
+	_, err = psubs[1].SubscribePrefix("metrics/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	checkPublished("metrics/cpu", true)
+
+	// a local subscriber
+	_, err = psubs[0].Subscribe("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPublished("local", true)
+	checkPublished("nobody", false)
+}
+
+func TestCancelIdempotent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := getNetHosts(t, ctx, 1)[0]
+	psub := getPubsub(ctx, host)
+
+	sub1, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub2, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub1.Cancel()
+		}()
+	}
+	wg.Wait()
+	sub1.Cancel()
+
+	_, err = sub1.Next(ctx)
+	if err != ErrSubscriptionCancelled {
+		t.Fatalf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+
+	// the other subscription to the topic is unaffected
+	if !psub.IsSubscribed("foobar") {
+		t.Fatal("expected to still be subscribed")
+	}
+
+	err = psub.Publish("foobar", []byte("still here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, sub2, []byte("still here"))
+
+	psub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		sub2.Cancel()
+		sub2.Cancel()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Cancel blocked after Close")
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psub := getPubsub(ctx, hosts[0], WithStreamIdleTimeout(time.Millisecond*150))
+	rawRPCs(hosts[1])
+	rawRPCs(hosts[2])
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	var ws []ggio.WriteCloser
+	for _, h := range hosts[1:] {
+		s, err := h.NewStream(ctx, hosts[0].ID(), ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws = append(ws, ggio.NewDelimitedWriter(s))
+	}
+
+	heartbeat := &pb.RPC{
+		Subscriptions: []*pb.RPC_SubOpts{{Topicid: proto.String("foobar"), Subscribe: proto.Bool(true)}},
+	}
+
+	// only the second peer keeps sending
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 75)
+		err := ws[1].WriteMsg(heartbeat)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertPeerList(t, psub.ListPeers(""), hosts[2].ID())
+
+	// the stream of the idle peer was closed
+	err := ws[0].WriteMsg(heartbeat)
+	if err == nil {
+		t.Fatal("expected writing to the stream of an idle peer to fail")
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithStreamIdleTimeout(-time.Second))
+	if err == nil {
+		t.Fatal("expected error for negative idle timeout")
+	}
+}
+
+func TestSubscriptionRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithSubscriptionRefreshInterval(time.Millisecond*100))
+	rpcs := rawRPCs(hosts[1])
+
+	for _, topic := range []string{"foo", "bar"} {
+		_, err := psub.Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	// the hello packet, then the refreshes
+	for i := 0; i < 3; i++ {
+		subs := nextRPC(t, rpcs).GetSubscriptions()
+		if len(subs) != 2 {
+			t.Fatalf("expected both subscriptions in rpc %d, got %d", i, len(subs))
+		}
+		for _, so := range subs {
+			if !so.GetSubscribe() {
+				t.Fatalf("expected a subscription to %s, got an unsubscription", so.GetTopicid())
+			}
+		}
+	}
+
+	_, err := NewFloodSub(ctx, hosts[0], WithSubscriptionRefreshInterval(0))
+	if err == nil {
+		t.Fatal("expected error for zero refresh interval")
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0])
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	long := string(make([]byte, MaxTopicLength+1))
+	var msgs []*pb.Message
+	for i, topics := range [][]string{nil, {""}, {"foobar", ""}, {"foobar", long}, {"foobar"}} {
+		msgs = append(msgs, &pb.Message{
+			From:     []byte(hosts[1].ID()),
+			Data:     []byte(fmt.Sprint(i)),
+			Seqno:    []byte(fmt.Sprintf("%08d", i)),
+			TopicIDs: topics,
+		})
+	}
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: msgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the well formed message gets through
+	assertReceive(t, sub, []byte("4"))
+
+	if n := psub.Stats().DroppedMalformed; n != 4 {
+		t.Fatalf("expected 4 malformed messages, got %d", n)
+	}
+
+	for _, topic := range []string{"", long} {
+		err := psub.Publish(topic, []byte("malformed"))
+		if err == nil {
+			t.Fatalf("expected error publishing to a topic of %d bytes", len(topic))
+		}
+	}
+}
+
+func TestMessageObserver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+
+	observed := make(chan *Message, 10)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithMessageObserver(func(msg *Message) {
+			observed <- msg
+		})),
+	}
+
+	var subs []*Subscription
+	for i := 0; i < 2; i++ {
+		sub, err := psubs[1].Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 3; i++ {
+		if err := psubs[0].Publish("foobar", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range subs {
+		for i := 0; i < 3; i++ {
+			assertReceive(t, sub, []byte(fmt.Sprint(i)))
+		}
+	}
+
+	// our own messages are observed as well
+	if err := psubs[1].Publish("foobar", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		assertReceive(t, sub, []byte("3"))
+	}
+
+	// the observer sees each message once, despite the two subscriptions
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-observed:
+			if string(msg.Data) != fmt.Sprint(i) {
+				t.Fatalf("expected message %d, got %s", i, msg.Data)
+			}
+			if msg.ReceivedAt.IsZero() {
+				t.Fatal("expected ReceivedAt to be set")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	select {
+	case msg := <-observed:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	_, err := NewFloodSub(ctx, hosts[0], WithMessageObserver(nil))
+	if err == nil {
+		t.Fatal("expected error for nil message observer")
+	}
+}
+
+func TestFlushSeenCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, opts := range [][]Option{nil, {WithSeenCacheSize(10)}} {
+		hosts := getNetHosts(t, ctx, 2)
+		psub := getPubsub(ctx, hosts[0], opts...)
+
+		sub, err := psub.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		connect(t, hosts[0], hosts[1])
+		s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		w := ggio.NewDelimitedWriter(s)
+		msg := &pb.Message{
+			From:     []byte(hosts[1].ID()),
+			Data:     []byte("foo"),
+			Seqno:    []byte("00000001"),
+			TopicIDs: []string{"foobar"},
+		}
+
+		for i := 0; i < 2; i++ {
+			err = w.WriteMsg(&pb.RPC{Publish: []*pb.Message{msg}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertReceive(t, sub, []byte("foo"))
+
+			if n := psub.SeenCacheLen(); n != 1 {
+				t.Fatalf("expected 1 seen message, got %d", n)
+			}
+			psub.FlushSeenCache()
+			if n := psub.SeenCacheLen(); n != 0 {
+				t.Fatalf("expected no seen messages after flushing, got %d", n)
+			}
+		}
+	}
+
+	// custom caches without Len and Reset are left alone
+	hosts := getNetHosts(t, ctx, 1)
+	cache := make(mapSeenCache)
+	cache.Add("foo")
+	psub := getPubsub(ctx, hosts[0], WithSeenCache(cache))
+	psub.FlushSeenCache()
+	if n := psub.SeenCacheLen(); n != -1 {
+		t.Fatalf("expected -1 for a cache without Len, got %d", n)
+	}
+	if !cache.Has("foo") {
+		t.Fatal("expected custom cache to be kept")
+	}
+}
+
+func TestSubscribeTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	sub, err := psubs[1].SubscribeTopics([]string{"foo", "bar", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := sub.Topics(); len(topics) != 2 || topics[0] != "foo" || topics[1] != "bar" {
+		t.Fatalf("expected topics foo and bar, got %v", topics)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	msgs := []struct {
+		topics  []string
+		matched string
+	}{
+		{[]string{"foo"}, "foo"},
+		{[]string{"baz"}, ""},
+		{[]string{"bar"}, "bar"},
+		{[]string{"baz", "bar", "foo"}, "bar"},
+	}
+	for i, m := range msgs {
+		if err := psubs[0].PublishMany(m.topics, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, m := range msgs {
+		if m.matched == "" {
+			continue
+		}
+
+		select {
+		case msg := <-sub.ch:
+			if string(msg.Data) != fmt.Sprint(i) {
+				t.Fatalf("expected message %d, got %s", i, msg.Data)
+			}
+			if msg.MatchedTopic != m.matched {
+				t.Fatalf("expected message %d to match %s, got %s", i, m.matched, msg.MatchedTopic)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	select {
+	case msg := <-sub.ch:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// leaving one of the topics cancels the subscription for both
+	if err := psubs[1].Unsubscribe("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Next(ctx); err != ErrSubscriptionCancelled {
+		t.Fatalf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+	if topics := psubs[1].GetTopics(); len(topics) != 0 {
+		t.Fatalf("expected no topics, got %v", topics)
+	}
+
+	if _, err := psubs[1].SubscribeTopics(nil); err == nil {
+		t.Fatal("expected error subscribing to no topics")
+	}
+}
+
+func TestPeerScore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0])
+
+	// only connected floodsub peers are scored
+	getPubsub(ctx, hosts[1])
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = psub.RegisterTopicValidator("foobar", func(_ peer.ID, msg *Message) bool {
+		return string(msg.Data) != "bad"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	msg := func(seqno string, data string, topics ...string) *pb.Message {
+		return &pb.Message{
+			From:     []byte(hosts[1].ID()),
+			Data:     []byte(data),
+			Seqno:    []byte(seqno),
+			TopicIDs: topics,
+		}
+	}
+	msgs := []*pb.Message{
+		msg("00000001", "foo", "foobar"),
+		msg("00000001", "foo", "foobar"),
+		msg("00000002", "bad", "foobar"),
+		msg("00000003", "malformed"),
+		msg("00000004", "bar", "foobar"),
+	}
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: msgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, sub, []byte("foo"))
+	assertReceive(t, sub, []byte("bar"))
+
+	exp := PeerScore{Messages: 5, Delivered: 2, Duplicates: 1, Invalid: 2}
+	if score := psub.PeerScore(hosts[1].ID()); score != exp {
+		t.Fatalf("expected score %+v, got %+v", exp, score)
+	}
+
+	if score := psub.PeerScore(hosts[0].ID()); score != (PeerScore{}) {
+		t.Fatalf("expected no score for ourselves, got %+v", score)
+	}
+}
+
+func TestLeafNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithForwarding(false)),
+		getPubsub(ctx, hosts[2]),
+	}
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	time.Sleep(time.Millisecond * 100)
+
+	// the leaf gets the message but doesn't pass it on
+	if err := psubs[0].Publish("foobar", []byte("relayed")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("relayed"))
+	assertReceive(t, subs[1], []byte("relayed"))
+
+	// its own messages still reach everyone
+	if err := psubs[1].Publish("foobar", []byte("own")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		assertReceive(t, sub, []byte("own"))
+	}
+
+	select {
+	case msg := <-subs[2].ch:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestLoopbackMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	connect(t, hosts[2], hosts[0])
+	time.Sleep(time.Millisecond * 100)
+
+	if err := psubs[0].Publish("foobar", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		assertReceive(t, sub, []byte("foo"))
+	}
+
+	// a peer closing the loop with a copy of the message under a new seqno
+	s, err := hosts[2].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: []*pb.Message{{
+		From:     []byte(hosts[0].ID()),
+		Data:     []byte("foo"),
+		Seqno:    []byte("loopback"),
+		TopicIDs: []string{"foobar"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-subs[0].ch:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := psubs[0].Stats().DroppedLoopback; n != 1 {
+		t.Fatalf("expected 1 looped back message, got %d", n)
+	}
+}
+
+func TestHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+	if psub.Host() != hosts[0] {
+		t.Fatal("expected the host the PubSub was created with")
+	}
+}
+
+func TestSlowPeerPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, policy := range []SlowPeerPolicy{DropSlowPeerMessage, DisconnectSlowPeer, BlockSlowPeer} {
+		hosts := getNetHosts(t, ctx, 2)
+		psub := getPubsub(ctx, hosts[0], WithSlowPeerPolicy(policy), WithSlowPeerTimeout(time.Second*5))
+
+		// a peer which subscribes to foobar but doesn't read until released
+		release := make(chan struct{})
+		var received int32
+		hosts[1].SetStreamHandler(ID, func(s inet.Stream) {
+			defer s.Close()
+			<-release
+			r := ggio.NewDelimitedReader(s, DefaultMaxMessageSize)
+			for {
+				rpc := new(pb.RPC)
+				if err := r.ReadMsg(rpc); err != nil {
+					return
+				}
+				atomic.AddInt32(&received, int32(len(rpc.GetPublish())))
+			}
+		})
+
+		connect(t, hosts[0], hosts[1])
+		s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		err = ggio.NewDelimitedWriter(s).WriteMsg(&rpcWithSubs(&pb.RPC_SubOpts{
+			Topicid:   proto.String("foobar"),
+			Subscribe: proto.Bool(true),
+		}).RPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+
+		if policy == BlockSlowPeer {
+			go func() {
+				time.Sleep(time.Millisecond * 100)
+				close(release)
+			}()
+		}
+
+		n := peerOutboundQueueSize * 2
+		for i := 0; i < n; i++ {
+			if err := psub.Publish("foobar", []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats := psub.Stats()
+		peers := psub.ListPeers("foobar")
+		switch policy {
+		case DropSlowPeerMessage:
+			close(release)
+			if stats.DroppedQueueFull == 0 {
+				t.Fatal("expected messages to be dropped")
+			}
+			if len(peers) != 1 {
+				t.Fatal("expected the slow peer to stay")
+			}
+		case DisconnectSlowPeer:
+			close(release)
+			if stats.DisconnectedSlowPeers != 1 {
+				t.Fatalf("expected 1 disconnected peer, got %d", stats.DisconnectedSlowPeers)
+			}
+			if len(peers) != 0 {
+				t.Fatal("expected the slow peer to be dropped")
+			}
+		case BlockSlowPeer:
+			if stats.DroppedQueueFull != 0 {
+				t.Fatalf("expected no dropped messages, got %d", stats.DroppedQueueFull)
+			}
+
+			deadline := time.Now().Add(time.Second * 5)
+			for atomic.LoadInt32(&received) != int32(n) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected %d messages, got %d", n, atomic.LoadInt32(&received))
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		}
+	}
+
+	_, err := NewFloodSub(ctx, getNetHosts(t, ctx, 1)[0], WithSlowPeerPolicy(SlowPeerPolicy(42)))
+	if err == nil {
+		t.Fatal("expected error for unknown slow peer policy")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	topics := make([]*Topic, 2)
+	subs := make([]*Subscription, 2)
+	for i, ps := range psubs {
+		topic, err := ps.Join("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := topic.Subscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		topics[i] = topic
+		subs[i] = sub
+	}
+
+	again, err := psubs[0].Join("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != topics[0] {
+		t.Fatal("expected joining twice to return the same handle")
+	}
+
+	// a subscription made without the handle
+	plain, err := psubs[0].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	if peers := topics[0].ListPeers(); len(peers) != 1 || peers[0] != hosts[1].ID() {
+		t.Fatalf("expected %s as the only peer, got %v", hosts[1].ID(), peers)
+	}
+
+	if err := topics[1].Publish([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("foo"))
+	assertReceive(t, plain, []byte("foo"))
+
+	// the first Close only undoes the second Join
+	if err := topics[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := topics[1].Publish([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("bar"))
+	assertReceive(t, plain, []byte("bar"))
+
+	if err := topics[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subs[0].Next(ctx); err != ErrSubscriptionCancelled {
+		t.Fatalf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+
+	// the other subscription keeps us on the topic
+	if err := topics[1].Publish([]byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, plain, []byte("baz"))
+
+	if err := topics[0].Close(); err == nil {
+		t.Fatal("expected error closing a closed topic")
+	}
+	if err := topics[0].Publish([]byte("closed")); err == nil {
+		t.Fatal("expected error publishing to a closed topic")
+	}
+	if _, err := topics[0].Subscribe(); err == nil {
+		t.Fatal("expected error subscribing to a closed topic")
+	}
+
+	rejoined, err := psubs[0].Join("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejoined == topics[0] {
+		t.Fatal("expected a new handle after closing the old one")
+	}
+}
+
+func TestDiscoveredTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	for i, topics := range [][]string{{"mine"}, {"foo", "bar"}, {"far away"}} {
+		for _, topic := range topics {
+			if _, err := psubs[i].Subscribe(topic); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	time.Sleep(time.Millisecond * 100)
+
+	topics := psubs[0].DiscoveredTopics()
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "bar" || topics[1] != "foo" {
+		t.Fatalf("expected topics bar and foo, got %v", topics)
+	}
+}
+
+func TestMaxForwardDegree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 5)
+	psubs := []*PubSub{getPubsub(ctx, hosts[0], WithMaxForwardDegree(2))}
+	psubs = append(psubs, getPubsubs(ctx, hosts[1:])...)
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	for _, h := range hosts[1:] {
+		connect(t, hosts[0], h)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// every peer gets picked eventually
+	reached := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		n, err := psubs[0].PublishCount("foobar", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("expected the message to reach 2 peers, got %d", n)
+		}
+
+		for j, sub := range subs {
+			select {
+			case <-sub.ch:
+				reached[j] = true
+			case <-time.After(time.Millisecond * 20):
+			}
+		}
+	}
+	if len(reached) != len(subs) {
+		t.Fatalf("expected all %d peers to be picked, got %d", len(subs), len(reached))
+	}
+
+	_, err := NewFloodSub(ctx, hosts[0], WithMaxForwardDegree(0))
+	if err == nil {
+		t.Fatal("expected error for a forward degree of 0")
+	}
+}
+
+func TestSubscribeUnsupportedDescriptor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	auth := pb.TopicDescriptor_AuthOpts_KEY
+	_, err := psub.SubscribeByTopicDescriptor(&pb.TopicDescriptor{
+		Name: proto.String("foobar"),
+		Auth: &pb.TopicDescriptor_AuthOpts{Mode: &auth},
+	})
+	if !errors.Is(err, ErrAuthUnsupported) {
+		t.Fatalf("expected ErrAuthUnsupported, got %v", err)
+	}
+
+	enc := pb.TopicDescriptor_EncOpts_SHAREDKEY
+	_, err = psub.SubscribeByTopicDescriptor(&pb.TopicDescriptor{
+		Name: proto.String("foobar"),
+		Enc:  &pb.TopicDescriptor_EncOpts{Mode: &enc},
+	})
+	if !errors.Is(err, ErrEncUnsupported) {
+		t.Fatalf("expected ErrEncUnsupported, got %v", err)
+	}
+}
+
+func TestPublishAs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts[:3])
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+	connect(t, hosts[1], hosts[2])
+	time.Sleep(time.Millisecond * 100)
+
+	// two gateways bridging the same message of an outside author
+	author := hosts[3].ID()
+	for _, ps := range psubs[:2] {
+		if err := ps.PublishAs(author, []byte("00000001"), "foobar", []byte("bridged")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sub := range subs {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer.ID(msg.GetFrom()) != author || string(msg.GetSeqno()) != "00000001" {
+			t.Fatalf("expected the message of %s with seqno 1, got %s %s", author, msg.GetFrom(), msg.GetSeqno())
+		}
+	}
+
+	// it is only delivered once
+	for _, sub := range subs {
+		select {
+		case msg := <-sub.ch:
+			t.Fatalf("unexpected message %s", msg.Data)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	err := psubs[0].PublishAs(hosts[0].ID(), []byte("00000002"), "foobar", []byte("spoofed"))
+	if err == nil {
+		t.Fatal("expected error publishing as the local host")
+	}
+
+	psub := getPubsub(ctx, hosts[3], WithPublishAsHost(true))
+	if err := psub.PublishAs(hosts[3].ID(), []byte("00000002"), "foobar", []byte("allowed")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	for i := 0; i < 2; i++ {
+		if _, err := psubs[0].Subscribe("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, topic := range []string{"foo", "bar"} {
+		if _, err := psubs[1].Subscribe(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	if err := psubs[0].Publish("foo", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := psubs[0].DebugSnapshot()
+	if s.Peers != 1 || s.SeenMessages != 1 {
+		t.Fatalf("expected 1 peer and 1 seen message, got %d and %d", s.Peers, s.SeenMessages)
+	}
+	if len(s.Topics) != 1 || s.Topics["foo"] != 2 {
+		t.Fatalf("expected 2 subscriptions to foo, got %v", s.Topics)
+	}
+
+	topics := s.PeerTopics[hosts[1].ID()]
+	sort.Strings(topics)
+	if len(s.PeerTopics) != 1 || len(topics) != 2 || topics[0] != "bar" || topics[1] != "foo" {
+		t.Fatalf("expected %s on bar and foo, got %v", hosts[1].ID(), s.PeerTopics)
+	}
+}
+
+func TestQueriesCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+
+	if _, err := psubs[0].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psubs[1].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	topics, err := psubs[0].GetTopicsCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0] != "foobar" {
+		t.Fatalf("expected topic foobar, got %v", topics)
+	}
+
+	peers, err := psubs[0].ListPeersCtx(ctx, "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != hosts[1].ID() {
+		t.Fatalf("expected peer %s, got %v", hosts[1].ID(), peers)
+	}
+
+	psubs[0].Close()
+	if _, err := psubs[0].GetTopicsCtx(ctx); err != ErrPubSubClosed {
+		t.Fatalf("expected ErrPubSubClosed, got %v", err)
+	}
+	if _, err := psubs[0].ListPeersCtx(ctx, "foobar"); err != ErrPubSubClosed {
+		t.Fatalf("expected ErrPubSubClosed, got %v", err)
+	}
+}
+
+func TestWorkerShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		// publish faster than the outbound queue drains without loss
+		getPubsub(ctx, hosts[0], WithSlowPeerPolicy(BlockSlowPeer), WithSlowPeerTimeout(time.Second)),
+		getPubsub(ctx, hosts[1], WithWorkerShards(4)),
+	}
+
+	var running, maxRunning int32
+	validator := func(_ peer.ID, msg *Message) bool {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+		return !bytes.HasPrefix(msg.Data, []byte("bad"))
+	}
+
+	var topics []string
+	var subs []*Subscription
+	for i := 0; i < 8; i++ {
+		topic := fmt.Sprint("topic", i)
+		if err := psubs[1].RegisterTopicValidator(topic, validator); err != nil {
+			t.Fatal(err)
+		}
+		sub, err := psubs[1].Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, topic)
+		subs = append(subs, sub)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 3; i++ {
+		for _, topic := range topics {
+			if err := psubs[0].Publish(topic, []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+			if err := psubs[0].Publish(topic, []byte("bad")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// each topic keeps its order, and invalid messages are dropped
+	for _, sub := range subs {
+		for i := 0; i < 3; i++ {
+			assertReceive(t, sub, []byte(fmt.Sprint(i)))
+		}
+	}
+
+	// the last invalid messages may still be on the workers
+	deadline := time.Now().Add(time.Second * 5)
+	for psubs[1].Stats().DroppedValidation != 24 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 24 invalid messages, got %d", psubs[1].Stats().DroppedValidation)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if atomic.LoadInt32(&maxRunning) < 2 {
+		t.Fatal("expected validators to run in parallel")
+	}
+
+	// our own messages are still validated before Publish returns
+	err := psubs[1].PublishValidated("topic0", []byte("bad"))
+	if err != ErrValidationFailed {
+		t.Fatalf("expected ErrValidationFailed, got %v", err)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithWorkerShards(0))
+	if err == nil {
+		t.Fatal("expected error for 0 worker shards")
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- psubs[0].WaitForPeers(ctx, 2)
+	}()
+
+	connect(t, hosts[0], hosts[1])
+	select {
+	case err := <-done:
+		t.Fatalf("returned with a single peer: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	connect(t, hosts[0], hosts[2])
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for peers")
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer tcancel()
+	if err := psubs[0].WaitForPeers(tctx, 3); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	first, err := psub.Subscribe("foobar", WithReplay(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b", "c"} {
+		if err := psub.Publish("foobar", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		assertReceive(t, first, []byte(data))
+	}
+
+	// late subscribers asking for it get the last messages first
+	late, err := psub.Subscribe("foobar", WithReplay(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := psub.Publish("foobar", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"b", "c", "d"} {
+		assertReceive(t, late, []byte(data))
+	}
+	assertReceive(t, plain, []byte("d"))
+
+	// leaving the topic forgets its messages
+	for _, sub := range []*Subscription{first, late, plain} {
+		sub.Cancel()
+	}
+	again, err := psub.Subscribe("foobar", WithReplay(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := psub.Publish("foobar", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, again, []byte("e"))
+
+	_, err = psub.Subscribe("foobar", WithReplay(DefaultSubscriptionBufferSize+1))
+	if err == nil {
+		t.Fatal("expected error for a replay exceeding the buffer size")
+	}
+}
+
+func TestSeqnoLength(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithSeqnoLength(0)),
+	}
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	var msgs []*pb.Message
+	for i, seqno := range []string{"", "123456789", "00000002"} {
+		msgs = append(msgs, &pb.Message{
+			From:     []byte(hosts[2].ID()),
+			Data:     []byte(fmt.Sprint(i)),
+			Seqno:    []byte(seqno),
+			TopicIDs: []string{"foobar"},
+		})
+	}
+
+	for _, h := range hosts[:2] {
+		connect(t, hosts[2], h)
+		s, err := hosts[2].NewStream(ctx, h.ID(), ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: msgs})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the 8 byte seqno gets through by default
+	assertReceive(t, subs[0], []byte("2"))
+	if n := psubs[0].Stats().DroppedMalformed; n != 2 {
+		t.Fatalf("expected 2 malformed messages, got %d", n)
+	}
+
+	// while a length of 0 accepts any seqno
+	for _, exp := range []string{"0", "1", "2"} {
+		assertReceive(t, subs[1], []byte(exp))
+	}
+	if n := psubs[1].Stats().DroppedMalformed; n != 0 {
+		t.Fatalf("expected no malformed messages, got %d", n)
+	}
+
+	err := psubs[0].PublishAs(hosts[2].ID(), []byte("short"), "foobar", []byte("x"))
+	if err == nil {
+		t.Fatal("expected error publishing with a short seqno")
+	}
+
+	_, err = NewFloodSub(ctx, hosts[2], WithSeqnoLength(-1))
+	if err == nil {
+		t.Fatal("expected error for a negative seqno length")
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+	connect(t, hosts[0], hosts[1])
+
+	even := func(msg *Message) bool {
+		return msg.GetData()[0]%2 == 0
+	}
+
+	// keeps the messages for replay
+	all, err := psubs[1].Subscribe("foobar", WithReplay(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := psubs[1].Subscribe("foobar", WithFilter(even))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := byte(0); i < 6; i++ {
+		if err := psubs[0].Publish("foobar", []byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := byte(0); i < 6; i++ {
+		assertReceive(t, all, []byte{i})
+	}
+	for i := byte(0); i < 6; i += 2 {
+		assertReceive(t, filtered, []byte{i})
+	}
+
+	// the odd messages were skipped rather than dropped
+	if n := psubs[1].Stats().DroppedSubscriberFull; n != 0 {
+		t.Fatalf("expected no dropped messages, got %d", n)
+	}
+
+	// replayed messages go through the filter too
+	late, err := psubs[1].Subscribe("foobar", WithReplay(6), WithFilter(even))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all.Cancel()
+
+	if err := psubs[0].Publish("foobar", []byte{6}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, filtered, []byte{6})
+	for i := byte(0); i <= 6; i += 2 {
+		assertReceive(t, late, []byte{i})
+	}
+
+	_, err = psubs[1].Subscribe("foobar", WithFilter(nil))
+	if err == nil {
+		t.Fatal("expected error for a nil filter")
+	}
+}
+
+func TestSubscribeAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+	connect(t, hosts[0], hosts[1])
+
+	all, err := psubs[1].SubscribeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Topic() != "" || len(all.Topics()) != 0 {
+		t.Fatalf("expected no topics, got %v", all.Topics())
+	}
+
+	sub, err := psubs[1].Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	// we don't receive bar, as we didn't subscribe to it
+	for _, topic := range []string{"bar", "foo"} {
+		if err := psubs[0].Publish(topic, []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertReceive(t, sub, []byte("foo"))
+
+	if err := psubs[1].Publish("baz", []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"foo", "baz"} {
+		msg, err := all.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetData()) != topic || msg.MatchedTopic != topic {
+			t.Fatalf("expected message on %s, got %q on %s", topic, msg.GetData(), msg.MatchedTopic)
+		}
+	}
+
+	// it doesn't announce any topic
+	if topics := psubs[1].GetTopics(); len(topics) != 1 {
+		t.Fatalf("expected to be subscribed to foo only, got %v", topics)
+	}
+
+	all.Cancel()
+	if _, err := all.Next(ctx); err != ErrSubscriptionCancelled {
+		t.Fatalf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+
+	_, err = psubs[1].SubscribeAll(WithReplay(1))
+	if err == nil {
+		t.Fatal("expected error replaying to SubscribeAll")
+	}
+}
+
+// flakyWriter writes at most half of each buffer, and fails with a
+// temporary error the first failures times
+type flakyWriter struct {
+	bytes.Buffer
+	failures int
+}
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "temporary failure" }
+func (temporaryErr) Timeout() bool   { return false }
+func (temporaryErr) Temporary() bool { return true }
+
+func (w *flakyWriter) Write(b []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		n, _ := w.Buffer.Write(b[:len(b)/2])
+		return n, temporaryErr{}
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestWriteRetries(t *testing.T) {
+	p := &PubSub{log: log}
+	ctx := context.Background()
+
+	w := &flakyWriter{failures: maxWriteRetries}
+	rw := &retryWriter{p: p, ctx: ctx, w: w}
+	n, err := rw.Write([]byte("some rpc bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 14 || w.String() != "some rpc bytes" {
+		t.Fatalf("expected the whole write once, got %d bytes %q", n, w.String())
+	}
+	if n := p.Stats().WriteRetries; n != maxWriteRetries {
+		t.Fatalf("expected %d retries, got %d", maxWriteRetries, n)
+	}
+
+	// one failure more and we give up
+	w = &flakyWriter{failures: maxWriteRetries + 1}
+	rw = &retryWriter{p: p, ctx: ctx, w: w}
+	if _, err := rw.Write([]byte("some rpc bytes")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithCompression(GzipCodec)),
+		getPubsub(ctx, hosts[1], WithCompression(GzipCodec)),
+		getPubsub(ctx, hosts[2]),
+	}
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	data := jsonPayload(4096)
+	msg, err := psubs[0].newMessage([]string{"foobar"}, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetCompression() != "gzip" || len(msg.GetData()) >= len(data) {
+		t.Fatalf("expected gzip compressed data, got %d bytes with codec %q", len(msg.GetData()), msg.GetCompression())
+	}
+
+	if err := psubs[0].Publish("foobar", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribers see the original data, also locally
+	for _, sub := range subs[:2] {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.GetData(), data) || msg.GetCompression() != "" {
+			t.Fatalf("expected the uncompressed data, got %d bytes with codec %q", len(msg.GetData()), msg.GetCompression())
+		}
+	}
+
+	// data compression wouldn't shrink goes out as is, which nodes without
+	// the codec can read
+	if err := psubs[0].Publish("foobar", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[2], []byte("x"))
+
+	if n := psubs[2].Stats().DroppedCompression; n != 1 {
+		t.Fatalf("expected 1 message dropped for its codec, got %d", n)
+	}
+
+	// data failing to decompress is dropped too
+	connect(t, hosts[3], hosts[1])
+	s, err := hosts[3].NewStream(ctx, hosts[1].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: []*pb.Message{{
+		From:        []byte(hosts[3].ID()),
+		Data:        []byte("not gzip"),
+		Seqno:       []byte("00000001"),
+		TopicIDs:    []string{"foobar"},
+		Compression: proto.String("gzip"),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if n := psubs[1].Stats().DroppedCompression; n != 1 {
+		t.Fatalf("expected 1 message failing to decompress, got %d", n)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[3], WithCompression(nil))
+	if err == nil {
+		t.Fatal("expected error for a nil codec")
+	}
+}
+
+func TestWriteRetryJitter(t *testing.T) {
+	d := writeRetryDelay
+	var lower, upper bool
+	for i := 0; i < 1000; i++ {
+		j := jitter(d)
+		if j < d/2 || j >= d*3/2 {
+			t.Fatalf("jitter of %s out of bounds: %s", d, j)
+		}
+		lower = lower || j < d
+		upper = upper || j > d
+	}
+
+	if !lower || !upper {
+		t.Fatal("expected delays both below and above the base delay")
+	}
+}
+
+func TestInvalidAuthor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0])
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var msgs []*pb.Message
+	for i, from := range [][]byte{nil, []byte("not a peer id"), []byte(hosts[1].ID())} {
+		msgs = append(msgs, &pb.Message{
+			From:     from,
+			Data:     []byte(fmt.Sprint(i)),
+			Seqno:    []byte(fmt.Sprintf("%08d", i)),
+			TopicIDs: []string{"foobar"},
+		})
+	}
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: msgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, sub, []byte("2"))
+	if n := psub.Stats().DroppedInvalidFrom; n != 2 {
+		t.Fatalf("expected 2 messages with an invalid author, got %d", n)
+	}
+
+	// we don't publish what our peers would drop
+	for _, from := range []peer.ID{"", "junk"} {
+		if err := psub.PublishAs(from, []byte("00000001"), "foobar", []byte("x")); err == nil {
+			t.Fatalf("expected error publishing as %q", from)
+		}
+	}
+}
+
+func TestSetHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts[:3])
+	connect(t, hosts[0], hosts[1])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	if err := psubs[1].Publish("foobar", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("before"))
+
+	if err := psubs[0].SetHost(hosts[3]); err != nil {
+		t.Fatal(err)
+	}
+	if psubs[0].Host() != hosts[3] {
+		t.Fatal("expected to run on the new host")
+	}
+	if n := psubs[0].PeerCount(); n != 0 {
+		t.Fatalf("expected the old peers to be dropped, got %d", n)
+	}
+
+	connect(t, hosts[3], hosts[2])
+	time.Sleep(time.Millisecond * 100)
+
+	assertPeerList(t, psubs[0].ListPeers("foobar"), hosts[2].ID())
+
+	// the old peer doesn't reach us anymore, the new one does with the
+	// subscription we kept
+	if err := psubs[1].Publish("foobar", []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := psubs[2].Publish("foobar", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("after"))
+
+	assertReceive(t, subs[2], []byte("after"))
+
+	if err := psubs[0].Publish("foobar", []byte("moved")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := subs[2].Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != "moved" || peer.ID(msg.GetFrom()) != hosts[3].ID() {
+		t.Fatalf("expected moved from the new host, got %q from %s", msg.GetData(), peer.ID(msg.GetFrom()))
+	}
+
+	if err := psubs[0].SetHost(nil); err == nil {
+		t.Fatal("expected error for a nil host")
+	}
+}
+
+func TestPublishWithReceipt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+	connect(t, hosts[0], hosts[1])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = psubs[0].RegisterTopicValidator("foobar", func(_ peer.ID, msg *Message) bool {
+		return string(msg.GetData()) != "invalid"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	reports := make(chan DeliveryReport, 1)
+	receipt := func(r DeliveryReport) {
+		reports <- r
+	}
+
+	if err := psubs[0].PublishWithReceipt("foobar", []byte("remote"), receipt); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reports; r.Peers != 1 || r.Delivered || r.Err != nil {
+		t.Fatalf("expected the message sent to 1 peer only, got %+v", r)
+	}
+	assertReceive(t, sub, []byte("remote"))
+
+	local, err := psubs[0].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := psubs[0].PublishWithReceipt("foobar", []byte("local"), receipt); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reports; r.Peers != 1 || !r.Delivered || r.Err != nil {
+		t.Fatalf("expected the message delivered and sent to 1 peer, got %+v", r)
+	}
+	assertReceive(t, local, []byte("local"))
+
+	if err := psubs[0].PublishWithReceipt("foobar", []byte("invalid"), receipt); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reports; r.Peers != 0 || r.Delivered || r.Err != ErrValidationFailed {
+		t.Fatalf("expected the message to fail validation, got %+v", r)
+	}
+
+	if err := psubs[0].PublishWithReceipt("foobar", []byte("x"), nil); err == nil {
+		t.Fatal("expected error for a nil callback")
+	}
+}
+
+func TestTopicValidator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	printable := func(topic string) error {
+		for _, r := range topic {
+			if r < ' ' || r == 0x7f {
+				return fmt.Errorf("control character %q", r)
+			}
+		}
+		return nil
+	}
+
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithTopicValidator(printable))
+
+	if _, err := psub.Subscribe(""); err == nil {
+		t.Fatal("expected error subscribing to an empty topic")
+	}
+	if _, err := psub.Subscribe("foo\nbar"); err == nil {
+		t.Fatal("expected error subscribing to a topic with a control character")
+	}
+	if err := psub.Publish("foo\nbar", []byte("x")); err == nil {
+		t.Fatal("expected error publishing to a topic with a control character")
+	}
+	if topics := psub.GetTopics(); len(topics) != 0 {
+		t.Fatalf("expected no topics, got %q", topics)
+	}
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{
+		Subscriptions: []*pb.RPC_SubOpts{{
+			Subscribe: proto.Bool(true),
+			Topicid:   proto.String("foo\x01bar"),
+		}},
+		Publish: []*pb.Message{{
+			From:     []byte(hosts[1].ID()),
+			Data:     []byte("bad"),
+			Seqno:    []byte("00000001"),
+			TopicIDs: []string{"foobar", "foo\x01bar"},
+		}, {
+			From:     []byte(hosts[1].ID()),
+			Data:     []byte("good"),
+			Seqno:    []byte("00000002"),
+			TopicIDs: []string{"foobar"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, sub, []byte("good"))
+
+	stats := psub.Stats()
+	if stats.RejectedSubscriptions != 1 || stats.DroppedMalformed != 1 {
+		t.Fatalf("expected 1 rejected subscription and 1 malformed message, got %+v", stats)
+	}
+	if topics := psub.DiscoveredTopics(); len(topics) != 0 {
+		t.Fatalf("expected no topics of peers, got %q", topics)
+	}
+}
+
+func TestLocalSubscriberCounts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	var subs []*Subscription
+	for _, topics := range [][]string{{"foo"}, {"foo"}, {"foo", "bar"}} {
+		sub, err := psub.SubscribeTopics(topics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	if _, err := psub.SubscribeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := psub.LocalSubscriberCounts()
+	if len(counts) != 2 || counts["foo"] != 3 || counts["bar"] != 1 {
+		t.Fatalf("expected 3 Subscriptions to foo and 1 to bar, got %v", counts)
+	}
+
+	subs[2].Cancel()
+	counts = psub.LocalSubscriberCounts()
+	if len(counts) != 1 || counts["foo"] != 2 {
+		t.Fatalf("expected 2 Subscriptions to foo, got %v", counts)
+	}
+
+	psub.Close()
+	if counts := psub.LocalSubscriberCounts(); counts != nil {
+		t.Fatalf("expected no counts once closed, got %v", counts)
+	}
+}
+
+func TestSubscriptionDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 1)
+	psub := getPubsub(ctx, hosts[0])
+
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := psub.Publish("foobar", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertReceive(t, sub, []byte("0"))
+
+	msgs := sub.Drain()
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 buffered messages, got %d", len(msgs))
+	}
+	for i, msg := range msgs {
+		if exp := fmt.Sprint(i + 1); string(msg.GetData()) != exp {
+			t.Fatalf("expected message %s, got %s", exp, msg.GetData())
+		}
+	}
+
+	if _, err := sub.Next(ctx); err != ErrSubscriptionCancelled {
+		t.Fatalf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+	if msgs := sub.Drain(); len(msgs) != 0 {
+		t.Fatalf("expected nothing left to drain, got %d messages", len(msgs))
+	}
+}
+
+// recordingLogger records the level of every message logged to it
+type recordingLogger struct {
+	lk     sync.Mutex
+	levels []LogLevel
+}
+
+func (l *recordingLogger) record(level LogLevel) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.levels = append(l.levels, level)
+}
+
+func (l *recordingLogger) logged() []LogLevel {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return append([]LogLevel(nil), l.levels...)
+}
+
+func (l *recordingLogger) Debug(...interface{})            { l.record(LogDebug) }
+func (l *recordingLogger) Debugf(string, ...interface{})   { l.record(LogDebug) }
+func (l *recordingLogger) Info(...interface{})             { l.record(LogInfo) }
+func (l *recordingLogger) Infof(string, ...interface{})    { l.record(LogInfo) }
+func (l *recordingLogger) Warning(...interface{})          { l.record(LogWarning) }
+func (l *recordingLogger) Warningf(string, ...interface{}) { l.record(LogWarning) }
+func (l *recordingLogger) Error(...interface{})            { l.record(LogError) }
+func (l *recordingLogger) Errorf(string, ...interface{})   { l.record(LogError) }
+
+func TestWithLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := new(recordingLogger)
+	hosts := getNetHosts(t, ctx, 2)
+	psub := getPubsub(ctx, hosts[0], WithLogger(FilterLogger(rec, LogWarning)))
+
+	// the peer speaks floodsub, so opening our stream to it succeeds
+	getPubsub(ctx, hosts[1])
+	connect(t, hosts[0], hosts[1])
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a malformed message logs at info level, one for a topic we aren't
+	// subscribed to as a warning
+	err = ggio.NewDelimitedWriter(s).WriteMsg(&pb.RPC{Publish: []*pb.Message{{
+		From:  []byte(hosts[1].ID()),
+		Seqno: []byte("00000001"),
+	}, {
+		From:     []byte(hosts[1].ID()),
+		Seqno:    []byte("00000002"),
+		TopicIDs: []string{"foobar"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if n := psub.Stats().DroppedMalformed; n != 1 {
+		t.Fatalf("expected 1 malformed message, got %d", n)
+	}
+
+	levels := rec.logged()
+	if len(levels) != 1 || levels[0] != LogWarning {
+		t.Fatalf("expected a single warning, got levels %v", levels)
+	}
+
+	_, err = NewFloodSub(ctx, hosts[1], WithLogger(nil))
+	if err == nil {
+		t.Fatal("expected error for a nil logger")
+	}
+}
+
+func TestRelayTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithRelayTopics([]string{"foobar"})),
+		getPubsub(ctx, hosts[2]),
+	}
+
+	// the relay is the only way between the ends
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	sub, err := psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := psubs[2].Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribing to a relayed topic and leaving it again doesn't stop
+	// the relaying
+	local, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Cancel()
+
+	time.Sleep(time.Millisecond * 100)
+
+	assertPeerList(t, psubs[0].ListPeers("foobar"), hosts[1].ID())
+	if topics := psubs[1].GetTopics(); len(topics) != 0 {
+		t.Fatalf("expected the relay not to be subscribed, got %q", topics)
+	}
+
+	for _, topic := range []string{"other", "foobar"} {
+		if err := psubs[0].Publish(topic, []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertReceive(t, sub, []byte("foobar"))
+
+	select {
+	case msg := <-other.ch:
+		t.Fatalf("got message on a topic the relay doesn't relay: %s", msg.GetData())
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	_, err = NewFloodSub(ctx, hosts[0], WithRelayTopics(nil))
+	if err == nil {
+		t.Fatal("expected error for no relay topics")
+	}
+}
+
+func TestFairIncoming(t *testing.T) {
+	p := &PubSub{}
+	if err := WithFairIncoming(4)(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chatty peer fills its buffer before a quiet one gets to send
+	slots := map[peer.ID]chan struct{}{
+		"chatty": make(chan struct{}, 4),
+		"quiet":  make(chan struct{}, 4),
+	}
+	push := func(pid peer.ID, data string) {
+		rpc := rpcWithMessages(&pb.Message{Data: []byte(data)})
+		rpc.from = pid
+		p.pushIncoming(rpc, slots[pid])
+	}
+	for i := 0; i < 4; i++ {
+		push("chatty", fmt.Sprint("c", i))
+	}
+	push("quiet", "q0")
+	push("quiet", "q1")
+
+	depths := p.IncomingQueueDepths()
+	if depths["chatty"] != 4 || depths["quiet"] != 2 {
+		t.Fatalf("expected depths of 4 and 2, got %v", depths)
+	}
+
+	// the full buffer blocks the chatty peer until one of its RPCs is taken
+	pushed := make(chan struct{})
+	go func() {
+		push("chatty", "c4")
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected the push to a full buffer to block")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	var order []string
+	for i := 0; i < 7; i++ {
+		if i == 1 {
+			<-pushed
+		}
+		order = append(order, string(p.fair.pop().Publish[0].GetData()))
+	}
+
+	exp := "c0 q0 c1 q1 c2 c3 c4"
+	if got := strings.Join(order, " "); got != exp {
+		t.Fatalf("expected the peers to take turns as %q, got %q", exp, got)
+	}
+	if rpc := p.fair.pop(); rpc != nil {
+		t.Fatal("expected no RPCs left")
+	}
+
+	// and it all still gets through end to end
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithFairIncoming(1)),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2]),
+	}
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[0], hosts[2])
+
+	sub, err := psubs[0].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	for i, ps := range psubs[1:] {
+		if err := ps.Publish("foobar", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(msg.GetData())] = true
+	}
+	if !got["0"] || !got["1"] {
+		t.Fatalf("expected the messages of both peers, got %v", got)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := getPubsubs(ctx, hosts)
+	connect(t, hosts[0], hosts[1])
+
+	requests, err := psubs[1].Subscribe("questions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the requester subscribes to its reply topic on the way, which the
+	// responder needs to see before replying
+	go func() {
+		for {
+			msg, err := requests.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			req, err := ParseRequest(msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for len(psubs[1].ListPeers(req.ReplyTopic)) == 0 {
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			// a reply to some other request comes first
+			other := &Request{ID: make([]byte, requestIDSize), ReplyTopic: req.ReplyTopic}
+			if err := psubs[1].Reply(other, []byte("not yours")); err != nil {
+				t.Error(err)
+			}
+			if err := psubs[1].Reply(req, bytes.ToUpper(req.Data)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	rctx, rcancel := context.WithTimeout(ctx, time.Second*5)
+	defer rcancel()
+	reply, err := psubs[0].Request(rctx, "questions", []byte("hello"), "answers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.GetData()) != "HELLO" {
+		t.Fatalf("expected HELLO, got %q", reply.GetData())
+	}
+
+	// the reply topic is left once the reply arrived
+	if psubs[0].IsSubscribed("answers") {
+		t.Fatal("expected the reply topic to be left")
+	}
+
+	// nobody answers on other topics
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer tcancel()
+	_, err = psubs[0].Request(tctx, "nobody", []byte("hello"), "answers")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+
+	if _, err := ParseRequest(&Message{Message: &pb.Message{Data: []byte("junk")}}); err != ErrMalformedRequest {
+		t.Fatalf("expected ErrMalformedRequest, got %v", err)
+	}
+}
+
+func TestHelloExtension(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := NewFloodSub(ctx, getNetHosts(t, ctx, 1)[0], WithHelloExtension(nil)); err == nil {
+		t.Fatal("expected empty hello extension to be rejected")
+	}
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0]),
+		getPubsub(ctx, hosts[1], WithHelloExtension([]byte("relay/v1"))),
+	}
+
+	evts0, err := psubs[0].SubscribePeerEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evts1, err := psubs[1].SubscribePeerEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+
+	// the hello may arrive before or after the connection event
+	var hello []byte
+	for connected := false; !connected || hello == nil; {
+		select {
+		case evt := <-evts0:
+			switch evt.Type {
+			case PeerConnected:
+				connected = true
+			case PeerHello:
+				if evt.Peer != hosts[1].ID() {
+					t.Fatalf("expected hello from %s, got %s", hosts[1].ID(), evt.Peer)
+				}
+				hello = evt.Hello
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for hello")
+		}
+	}
+	if string(hello) != "relay/v1" {
+		t.Fatalf("expected hello extension relay/v1, got %q", hello)
+	}
+
+	// the hello is only sent once, and not by nodes without the option
+	sub, err := psubs[0].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	time.Sleep(time.Millisecond * 100)
+
+	deadline := time.After(time.Millisecond * 200)
+	for {
+		select {
+		case evt := <-evts0:
+			t.Fatalf("got unexpected peer event %s", evt.Type)
+		case evt := <-evts1:
+			if evt.Type == PeerHello {
+				t.Fatalf("got unexpected hello from %s", evt.Peer)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := getNetHosts(t, ctx, 1)[0]
+	if _, err := NewFloodSub(ctx, h, WithLoadShedding(2, 2)); err == nil {
+		t.Fatal("expected marks without hysteresis to be rejected")
+	}
+	if _, err := NewFloodSub(ctx, h, WithIncomingQueueSize(8), WithLoadShedding(16, 4)); err == nil {
+		t.Fatal("expected high-water mark beyond the queue size to be rejected")
+	}
+	if _, err := NewFloodSub(ctx, h, WithTopicPriority("foo", PriorityHigh+1)); err == nil {
+		t.Fatal("expected invalid priority to be rejected")
+	}
+
+	p := &PubSub{log: log, incomingSize: 8}
+	p.shedding.priorities = make(map[string]TopicPriority)
+	for _, opt := range []Option{
+		WithLoadShedding(4, 2),
+		WithTopicPriority("low", PriorityLow),
+		WithTopicPriority("critical", PriorityHigh),
+	} {
+		if err := opt(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := func(topics ...string) *pb.Message {
+		return &pb.Message{TopicIDs: topics}
+	}
+	check := func(depth int, topics []string, shed bool) {
+		t.Helper()
+		p.updateShedding(depth)
+		if got := p.shedsMsg(msg(topics...)); got != shed {
+			t.Fatalf("at depth %d, expected shedding %v to be %v", depth, topics, shed)
+		}
+	}
+
+	check(4, []string{"low"}, false)
+	check(5, []string{"low"}, true)
+	check(5, []string{"normal"}, false)
+	// shedding continues until we are below the low-water mark
+	check(2, []string{"low"}, true)
+	check(8, []string{"normal"}, true)
+	check(8, []string{"low", "critical"}, false)
+	check(1, []string{"low"}, false)
+	check(3, []string{"low"}, false)
+}
+
+func TestLastSeqno(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts)
+
+	// hosts[0] sees the messages of hosts[2] through hosts[1]
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if _, ok := psubs[0].LastSeqno(hosts[2].ID()); ok {
+		t.Fatal("expected no seqno before receiving messages")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := psubs[2].Publish("foobar", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := subs[0].Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seqno, ok := psubs[0].LastSeqno(hosts[2].ID())
+		if !ok || seqno != binary.BigEndian.Uint64(msg.GetSeqno()) {
+			t.Fatalf("expected last seqno %x, got %d (%v)", msg.GetSeqno(), seqno, ok)
+		}
+	}
+
+	// older seqnos don't move it back
+	last, _ := psubs[0].LastSeqno(hosts[2].ID())
+	p := &PubSub{lastSeqnos: map[peer.ID]uint64{hosts[2].ID(): last}}
+	var older [8]byte
+	binary.BigEndian.PutUint64(older[:], last-1)
+	p.trackSeqno(&pb.Message{From: []byte(hosts[2].ID()), Seqno: older[:]})
+	if p.lastSeqnos[hosts[2].ID()] != last {
+		t.Fatal("expected older seqno to be ignored")
+	}
+
+	if _, ok := psubs[1].LastSeqno(hosts[2].ID()); !ok {
+		t.Fatal("expected relay to track the seqno of its peer")
+	}
+	psubs[1].BlacklistPeer(hosts[2].ID())
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := psubs[1].LastSeqno(hosts[2].ID()); ok {
+		t.Fatal("expected seqno to be forgotten once the peer was dropped")
+	}
+}
+
+func TestPublishRaw(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := getPubsubs(ctx, hosts[:2])
+
+	sub, err := psubs[1].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	author := []byte(hosts[2].ID())
+	for _, pmsg := range []*pb.Message{
+		nil,
+		{From: []byte("junk"), Seqno: []byte("00000001"), TopicIDs: []string{"foobar"}},
+		{From: author, TopicIDs: []string{"foobar"}},
+		{From: author, Seqno: []byte("1"), TopicIDs: []string{"foobar"}},
+		{From: author, Seqno: []byte("00000001")},
+		{From: []byte(hosts[0].ID()), Seqno: []byte("00000001"), TopicIDs: []string{"foobar"}},
+	} {
+		if err := psubs[0].PublishRaw(pmsg); err == nil {
+			t.Fatalf("expected error publishing %v", pmsg)
+		}
+	}
+
+	pmsg := &pb.Message{
+		From:     author,
+		Seqno:    []byte("00000001"),
+		TopicIDs: []string{"foobar"},
+		Data:     []byte("raw"),
+	}
+	for i := 0; i < 2; i++ {
+		if err := psubs[0].PublishRaw(pmsg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetFrom() != hosts[2].ID() || string(msg.GetData()) != "raw" {
+		t.Fatalf("expected raw message of %s, got %s from %s", hosts[2].ID(), msg.GetData(), msg.GetFrom())
+	}
+
+	// the second copy was deduplicated
+	select {
+	case msg := <-sub.ch:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPeerExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 4)
+	psubs := getPubsubs(ctx, hosts[:3], WithPeerExchange(true))
+	psubs = append(psubs, getPubsub(ctx, hosts[3]))
+
+	// hosts[1] knows everyone, the others only know hosts[1]
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+	connect(t, hosts[1], hosts[3])
+
+	for _, ps := range psubs[1:3] {
+		if _, err := ps.Subscribe("foobar"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// joining the topic gets us connected to hosts[2] through hosts[1]
+	if _, err := psubs[0].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	assertPeerList(t, psubs[0].ListPeers(""), hosts[1].ID(), hosts[2].ID())
+
+	// a node without peer exchange isn't told about anyone
+	if _, err := psubs[3].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	assertPeerList(t, psubs[3].ListPeers(""), hosts[1].ID())
+}
+
+func TestLocalLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 2)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithLocalLoopback(false)),
+		getPubsub(ctx, hosts[1]),
+	}
+
+	var subs []*Subscription
+	for _, ps := range psubs {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	// with nobody else on the topic, there is no one to publish to
+	ok, err := psubs[0].PublishIfSubscribers("foobar", []byte("alone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected message without remote subscribers to be skipped")
+	}
+
+	connect(t, hosts[0], hosts[1])
+	time.Sleep(time.Millisecond * 100)
+
+	if err := psubs[0].Publish("foobar", []byte("mine")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[1], []byte("mine"))
+
+	// messages of our peers are still delivered
+	if err := psubs[1].Publish("foobar", []byte("theirs")); err != nil {
+		t.Fatal(err)
+	}
+	assertReceive(t, subs[0], []byte("theirs"))
+	assertReceive(t, subs[1], []byte("theirs"))
+
+	select {
+	case msg := <-subs[0].ch:
+		t.Fatalf("unexpected message %s", msg.Data)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithDirectPeers([]pstore.PeerInfo{hosts[1].Peerstore().PeerInfo(hosts[1].ID())})),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2]),
+	}
+	connect(t, hosts[0], hosts[2])
+	time.Sleep(time.Millisecond * 100)
+
+	if _, ok := psubs[1].PeerInfo(hosts[2].ID()); ok {
+		t.Fatal("expected no info on a peer we have no session with")
+	}
+
+	info, ok := psubs[0].PeerInfo(hosts[1].ID())
+	if !ok {
+		t.Fatal("expected info on direct peer")
+	}
+	if !info.DialedByPubSub {
+		t.Fatal("expected direct peer to be dialed by us")
+	}
+	if addr := hosts[1].Addrs()[0]; !info.RemoteAddr.Equal(addr) {
+		t.Fatalf("expected remote address %s, got %s", addr, info.RemoteAddr)
+	}
+
+	if info, ok := psubs[1].PeerInfo(hosts[0].ID()); !ok || info.DialedByPubSub {
+		t.Fatalf("expected info on dialing peer, not marked as dialed by us, got %+v (%v)", info, ok)
+	}
+
+	// connections made by the host aren't known to be dialed by us
+	if info, ok := psubs[0].PeerInfo(hosts[2].ID()); !ok || info.DialedByPubSub {
+		t.Fatalf("expected info on peer connected by the host, got %+v (%v)", info, ok)
+	}
+
+	psubs[1].BlacklistPeer(hosts[0].ID())
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := psubs[1].PeerInfo(hosts[0].ID()); ok {
+		t.Fatal("expected info to be cleared once the peer was dropped")
+	}
+}
+
+func TestMetricsRegisterFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the last collector clashes with one registered by someone else
+	reg := prometheus.NewRegistry()
+	clash := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "floodsub",
+		Name:      "incoming_queue_capacity",
+		Help:      "Number of RPCs from peers which can wait for the event loop.",
+	})
+	reg.MustRegister(clash)
+
+	h := getNetHosts(t, ctx, 1)[0]
+	if _, err := NewFloodSub(ctx, h, WithMetricsRegisterer(reg)); err == nil {
+		t.Fatal("expected clashing metrics to be rejected")
+	}
+
+	// the collectors registered before the failure were unregistered
+	reg.Unregister(clash)
+	if _, err := NewFloodSub(ctx, h, WithMetricsRegisterer(reg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFragmentGroupLimits(t *testing.T) {
+	p := &PubSub{log: log}
+	p.fragments = fragmentation{
+		size:    10,
+		timeout: time.Minute,
+		groups:  make(map[string]*fragmentGroup),
+		origins: make(map[string]int),
+	}
+
+	first := func(origin string, group int) *pb.Message {
+		return &pb.Message{
+			From:          []byte(origin),
+			Data:          []byte("part"),
+			FragmentGroup: []byte(fmt.Sprintf("group%03d", group)),
+			FragmentIndex: proto.Uint32(0),
+			FragmentCount: proto.Uint32(2),
+		}
+	}
+
+	// one origin opening new groups only displaces its own oldest ones
+	for i := 0; i <= maxOriginFragmentGroups; i++ {
+		p.addFragment("", nil, first("spammer", i))
+	}
+	if n := p.fragments.origins["spammer"]; n != maxOriginFragmentGroups {
+		t.Fatalf("expected %d groups of the origin, got %d", maxOriginFragmentGroups, n)
+	}
+	if _, ok := p.fragments.groups["spammer"+"group000"]; ok {
+		t.Fatal("expected the oldest group to be dropped")
+	}
+	if n := p.Stats().DroppedFragments; n != 1 {
+		t.Fatalf("expected 1 dropped fragment, got %d", n)
+	}
+
+	// all origins together can't hold more than maxFragmentGroups
+	for o := 0; len(p.fragments.groups) < maxFragmentGroups; o++ {
+		p.addFragment("", nil, first(fmt.Sprintf("origin%d", o), 0))
+	}
+	p.addFragment("", nil, first("latecomer", 0))
+	if n := len(p.fragments.groups); n != maxFragmentGroups {
+		t.Fatalf("expected %d groups, got %d", maxFragmentGroups, n)
+	}
+	if _, ok := p.fragments.groups["latecomer"+"group000"]; !ok {
+		t.Fatal("expected the new group to be kept")
+	}
+	if n := p.Stats().DroppedFragments; n != 2 {
+		t.Fatalf("expected 2 dropped fragments, got %d", n)
+	}
+}
+
+func TestFragmentValidationBeforeRelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithFragmentation(10)),
+		getPubsub(ctx, hosts[1], WithFragmentation(10)),
+		getPubsub(ctx, hosts[2]),
+	}
+
+	// the middle node validates messages before relaying their fragments
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	err := psubs[1].RegisterTopicValidator("foobar", func(_ peer.ID, msg *Message) bool {
+		return !bytes.Contains(msg.GetData(), []byte("invalid"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psubs[1].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	if err := psubs[0].Publish("foobar", []byte("this invalid message has 4 parts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := psubs[0].Publish("foobar", []byte("this message is fine, 3 parts")); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the fragments of the valid message get past the middle node
+	for i := 0; i < 3; i++ {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetFragmentIndex() != uint32(i) || msg.GetFragmentCount() != 3 {
+			t.Fatalf("expected fragment %d of 3, got %d of %d", i, msg.GetFragmentIndex(), msg.GetFragmentCount())
+		}
+	}
+
+	select {
+	case msg := <-sub.ch:
+		t.Fatalf("unexpected fragment %d of %d", msg.GetFragmentIndex(), msg.GetFragmentCount())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// nonceCipher is a toy TopicCipher giving a different ciphertext every
+// time, for up to 255 messages
+type nonceCipher struct{}
+
+var cipherNonce uint32
+
+func (nonceCipher) Encrypt(data []byte) ([]byte, error) {
+	nonce := byte(atomic.AddUint32(&cipherNonce, 1))
+	out := []byte{nonce}
+	for _, b := range data {
+		out = append(out, b^nonce)
+	}
+	return out, nil
+}
+
+func (nonceCipher) Decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("not encrypted")
+	}
+
+	var out []byte
+	for _, b := range data[1:] {
+		out = append(out, b^data[0])
+	}
+	return out, nil
+}
+
+func TestContentDedupEncrypted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithTopicCipher("secret", nonceCipher{})),
+		getPubsub(ctx, hosts[1], WithTopicCipher("secret", nonceCipher{})),
+		getPubsub(ctx, hosts[2], WithTopicCipher("secret", nonceCipher{}), WithContentDedup(time.Minute)),
+	}
+
+	connect(t, hosts[0], hosts[2])
+	connect(t, hosts[1], hosts[2])
+
+	sub, err := psubs[2].Subscribe("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	// the ciphertexts differ, the content doesn't
+	msg := []byte("same old secret")
+	for _, ps := range psubs[:2] {
+		if err := ps.Publish("secret", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertReceive(t, sub, msg)
+	select {
+	case <-sub.ch:
+		t.Fatal("got the same content twice")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := psubs[2].Stats().DroppedContentDup; n != 1 {
+		t.Fatalf("expected 1 content duplicate, got %d", n)
+	}
+}
+
+func TestCompressionRelayWithoutCodec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, ctx, 3)
+	psubs := []*PubSub{
+		getPubsub(ctx, hosts[0], WithCompression(GzipCodec)),
+		getPubsub(ctx, hosts[1]),
+		getPubsub(ctx, hosts[2], WithCompression(GzipCodec)),
+	}
+
+	// the node in the middle can't read compressed messages
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	var subs []*Subscription
+	for _, ps := range psubs[1:] {
+		sub, err := ps.Subscribe("foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	data := jsonPayload(4096)
+	if err := psubs[0].Publish("foobar", data); err != nil {
+		t.Fatal(err)
+	}
+
+	assertReceive(t, subs[1], data)
+	select {
+	case msg := <-subs[0].ch:
+		t.Fatalf("got compressed message with codec %q", msg.GetCompression())
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if n := psubs[1].Stats().DroppedCompression; n != 1 {
+		t.Fatalf("expected 1 message not delivered for its codec, got %d", n)
+	}
+}
+
+func TestClosedErrAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	psub := getPubsub(ctx, getNetHosts(t, context.Background(), 1)[0])
+	sub, err := psub.Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := sub.Next(context.Background()); err != context.Canceled {
+		t.Fatalf("expected %v from Next, got %v", context.Canceled, err)
+	}
+
+	// every method tells why the PubSub is gone the same way
+	errs := map[string]error{
+		"Unsubscribe":              psub.Unsubscribe("foobar"),
+		"RegisterTopicValidator":   psub.RegisterTopicValidator("foobar", func(peer.ID, *Message) bool { return true }),
+		"UnregisterTopicValidator": psub.UnregisterTopicValidator("foobar"),
+	}
+	_, errs["SubscribeTopicEvents"] = psub.SubscribeTopicEvents(context.Background())
+	_, errs["SubscribePeerEvents"] = psub.SubscribePeerEvents(context.Background())
+	for name, err := range errs {
+		if err != context.Canceled {
+			t.Errorf("expected %v from %s, got %v", context.Canceled, name, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package floodsubtest sets up floodsub instances on local hosts, for
+// integration tests of applications built on floodsub.
+package floodsubtest
+
+import (
+	"context"
+	"testing"
+
+	floodsub "github.com/libp2p/go-floodsub"
+
+	bhost "github.com/libp2p/go-libp2p-blankhost"
+	netutil "github.com/libp2p/go-libp2p-netutil"
+)
+
+// NewTestPubSubs returns n PubSubs configured by opts, each on a host of its
+// own. The hosts aren't connected to each other; use Connect, ConnectAll or
+// the hosts returned by Host to build a topology. The returned func closes
+// the PubSubs and their hosts.
+func NewTestPubSubs(t *testing.T, ctx context.Context, n int, opts ...floodsub.Option) ([]*floodsub.PubSub, func()) {
+	var psubs []*floodsub.PubSub
+	cleanup := func() {
+		for _, ps := range psubs {
+			ps.Close()
+			ps.Host().Close()
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		h := bhost.NewBlankHost(netutil.GenSwarmNetwork(t, ctx))
+		ps, err := floodsub.NewFloodSub(ctx, h, opts...)
+		if err != nil {
+			h.Close()
+			cleanup()
+			t.Fatal(err)
+		}
+		psubs = append(psubs, ps)
+	}
+
+	return psubs, cleanup
+}
+
+// Connect connects the hosts of a and b, which starts a pubsub session
+// between them.
+func Connect(t *testing.T, a, b *floodsub.PubSub) {
+	ha, hb := a.Host(), b.Host()
+	pinfo := ha.Peerstore().PeerInfo(ha.ID())
+	if err := hb.Connect(context.Background(), pinfo); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ConnectAll connects every pair of psubs.
+func ConnectAll(t *testing.T, psubs []*floodsub.PubSub) {
+	for i, a := range psubs {
+		for _, b := range psubs[i+1:] {
+			Connect(t, a, b)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package floodsubtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewTestPubSubs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	psubs, cleanup := NewTestPubSubs(t, ctx, 3)
+	defer cleanup()
+
+	// a line topology: the ends only reach each other through the middle
+	Connect(t, psubs[0], psubs[1])
+	Connect(t, psubs[1], psubs[2])
+
+	sub, err := psubs[2].Subscribe("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psubs[1].Subscribe("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if n := len(psubs[0].ListPeers("")); n != 1 {
+		t.Fatalf("expected 1 peer, got %d", n)
+	}
+
+	if err := psubs[0].Publish("foobar", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != "hello" {
+		t.Fatalf("expected hello, got %s", msg.GetData())
+	}
+
+	cleanup()
+	if err := psubs[0].Publish("foobar", []byte("closed")); err == nil {
+		t.Fatal("expected publishing to fail after cleanup")
+	}
+}
@@ -0,0 +1,133 @@
+package floodsub
+
+import (
+	"fmt"
+	"math/rand"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ForwardPolicy picks the peers a message is sent to among the candidates,
+// our peers which are subscribed to it, omitting the peer we got it from.
+// It may return any subset of the candidates, e.g. to flood only partially
+// or to limit the degree. Peers not among the candidates are ignored. The
+// policy runs inside the event loop, so it must be fast and must not block,
+// and it must neither keep nor modify the message.
+type ForwardPolicy func(msg *Message, candidates []peer.ID) []peer.ID
+
+// WithForwardPolicy makes us send messages, ours and those we relay, only to
+// the peers picked by fp. By default we send to all candidates.
+func WithForwardPolicy(fp ForwardPolicy) Option {
+	return func(p *PubSub) error {
+		if fp == nil {
+			return fmt.Errorf("forward policy must not be nil")
+		}
+
+		p.forwardPolicy = fp
+		return nil
+	}
+}
+
+// WithMaxForwardDegree makes us send each message, ours and those we relay,
+// to at most d of the candidates, picked at random, and after the policy set
+// with WithForwardPolicy. Combined with a TTL, this floods probabilistically:
+// with a degree large enough for the size of the network, messages still
+// reach almost all subscribers, at a fraction of the bandwidth.
+func WithMaxForwardDegree(d int) Option {
+	return func(p *PubSub) error {
+		if d < 1 {
+			return fmt.Errorf("forward degree must be positive, got %d", d)
+		}
+
+		p.maxDegree = d
+		return nil
+	}
+}
+
+// pickRandom returns n of the candidates picked uniformly at random. It
+// reorders candidates.
+func pickRandom(candidates []peer.ID, n int) []peer.ID {
+	for i := 0; i < n; i++ {
+		j := i + rand.Intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates[:n]
+}
+
+// WithForwarding(false) makes us a leaf node, which receives messages and
+// publishes its own but doesn't relay the messages of its peers, saving the
+// bandwidth of forwarding. Floodsub relies on every node relaying, so peers
+// only connected to each other through leaf nodes don't get each other's
+// messages; leaf nodes should be connected to relaying nodes only, and
+// there must be enough of those for the relaying nodes to stay connected
+// among themselves. Forwarding is enabled by default.
+func WithForwarding(enabled bool) Option {
+	return func(p *PubSub) error {
+		p.leaf = !enabled
+		return nil
+	}
+}
+
+// WithRelayTopics makes us relay the messages on the given topics without
+// subscribing to them, e.g. for dedicated relay nodes. We announce the
+// topics to our peers like subscriptions, so they send us their messages,
+// and forward the messages to the peers subscribed to them. They are only
+// delivered to Subscriptions we make ourselves. Wildcard topics relay all
+// matching topics; relaying TopicWildcard alone relays everything peers
+// supporting wildcards pass on.
+func WithRelayTopics(topics []string) Option {
+	return func(p *PubSub) error {
+		if len(topics) == 0 {
+			return fmt.Errorf("no topics to relay")
+		}
+
+		for _, t := range topics {
+			if t == "" {
+				return fmt.Errorf("relay topic must not be empty")
+			}
+			p.relayTopics[t] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// relaysMsg returns whether one of the topics of msg is set to be relayed
+// with WithRelayTopics.
+func (p *PubSub) relaysMsg(msg *pb.Message) bool {
+	for t := range p.relayTopics {
+		if prefix, ok := wildcardPrefix(t); ok {
+			if msgHasTopicPrefix(msg, prefix) {
+				return true
+			}
+			continue
+		}
+
+		for _, mt := range msg.GetTopicIDs() {
+			if mt == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyForwardPolicy returns the candidates picked by the forward policy,
+// each at most once.
+// Only called from processLoop.
+func (p *PubSub) applyForwardPolicy(msg *pb.Message, candidates []peer.ID) []peer.ID {
+	allowed := make(map[peer.ID]struct{}, len(candidates))
+	for _, pid := range candidates {
+		allowed[pid] = struct{}{}
+	}
+
+	var out []peer.ID
+	for _, pid := range p.forwardPolicy(&Message{Message: msg}, candidates) {
+		if _, ok := allowed[pid]; ok {
+			delete(allowed, pid)
+			out = append(out, pid)
+		}
+	}
+	return out
+}
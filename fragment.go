@@ -0,0 +1,335 @@
+package floodsub
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultFragmentTimeout is how long we keep the fragments of an incomplete
+// message, unless configured otherwise with WithFragmentTimeout
+const DefaultFragmentTimeout = time.Second * 30
+
+// MaxFragments is the largest number of fragments a message may be split
+// into
+const MaxFragments = 1024
+
+const (
+	// maxFragmentGroups caps the incomplete messages we hold fragments of
+	maxFragmentGroups = 256
+
+	// maxOriginFragmentGroups caps the incomplete messages of one origin
+	// we hold fragments of
+	maxOriginFragmentGroups = 8
+)
+
+// fragmentation holds the settings and reassembly state of fragmented
+// messages
+type fragmentation struct {
+	// size is the largest amount of data we put in a fragment, 0 if
+	// fragmentation is disabled
+	size    int
+	timeout time.Duration
+
+	// groups holds the incomplete messages by origin and group
+	groups map[string]*fragmentGroup
+
+	// origins counts the groups of each origin
+	origins map[string]int
+
+	// expire fires when incomplete messages are due to be checked for
+	// expiry, and is nil while there are none
+	expire <-chan time.Time
+}
+
+// fragmentGroup holds the fragments of a message received so far
+type fragmentGroup struct {
+	origin  string
+	parts   [][]byte
+	have    []bool
+	count   int
+	size    int
+	created time.Time
+
+	// held holds the fragments as they arrived, relayed once the message
+	// is complete and valid
+	held []heldFragment
+}
+
+// heldFragment is a fragment waiting to be relayed, and the peer it came
+// from
+type heldFragment struct {
+	from peer.ID
+	pmsg *pb.Message
+}
+
+// WithFragmentation splits the data of messages we publish into fragments
+// of at most size bytes, sent as separate messages, and reassembles
+// fragmented messages we receive before validating and delivering them. We
+// hold the fragments of at most maxFragmentGroups incomplete messages, and
+// at most maxOriginFragmentGroups of one origin, dropping those of the
+// oldest message to make room for a new one.
+// Fragments are only relayed once the whole message arrived and passed
+// validation, so invalid fragmented messages don't spread past us, at the
+// cost of fragmented messages travelling slower. Nodes without fragmentation
+// relay
+// fragments like any message, but deliver them to their subscribers one by
+// one. Messages may be split into at most MaxFragments fragments. Only
+// Publish, PublishMany, PublishTo and PublishWithTTL fragment messages.
+func WithFragmentation(size int) Option {
+	return func(p *PubSub) error {
+		if size < 1 {
+			return fmt.Errorf("fragment size must be positive, got %d", size)
+		}
+
+		p.fragments.size = size
+		return nil
+	}
+}
+
+// WithFragmentTimeout sets how long we wait for the missing fragments of a
+// message before dropping the ones we have, counting them in
+// Stats.DroppedFragments. Defaults to DefaultFragmentTimeout.
+func WithFragmentTimeout(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d <= 0 {
+			return fmt.Errorf("fragment timeout must be positive, got %s", d)
+		}
+
+		p.fragments.timeout = d
+		return nil
+	}
+}
+
+// newFragments builds our messages carrying data under the given topics,
+// split into fragments if fragmentation is enabled and data doesn't fit
+// into one.
+func (p *PubSub) newFragments(topics []string, data []byte, ttl *uint32) ([]*Message, error) {
+	size := p.fragments.size
+	if size == 0 || len(data) <= size {
+		msg, err := p.newMessage(topics, data, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []*Message{msg}, nil
+	}
+
+	count := (len(data) + size - 1) / size
+	if count > MaxFragments {
+		return nil, fmt.Errorf("message of %d bytes needs more than %d fragments", len(data), MaxFragments)
+	}
+
+	msgs := make([]*Message, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		msg, err := p.newMessage(topics, data[i*size:end], ttl)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(msgs) == 0 {
+			msg.FragmentGroup = msg.Seqno
+		} else {
+			msg.FragmentGroup = msgs[0].Seqno
+		}
+		msg.FragmentIndex = proto.Uint32(uint32(i))
+		msg.FragmentCount = proto.Uint32(uint32(count))
+
+		err = p.checkMessageSize(msg.Message)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// publishFragments hands messages built by newFragments to processLoop.
+func (p *PubSub) publishFragments(msgs []*Message, peers map[peer.ID]struct{}) error {
+	if len(msgs) == 1 {
+		return p.pushPublish(&publishReq{msg: msgs[0], peers: peers})
+	}
+	return p.pushPublish(&publishReq{batch: msgs, peers: peers})
+}
+
+func isFragment(pmsg *pb.Message) bool {
+	return pmsg.FragmentCount != nil
+}
+
+// addFragment stores a fragment received from the peer from, and returns
+// the reassembled message along with its fragments once all of them
+// arrived. dmsg is the decrypted pmsg.
+// Only called from processLoop.
+func (p *PubSub) addFragment(from peer.ID, pmsg, dmsg *pb.Message) (*pb.Message, []heldFragment, bool) {
+	n := int(dmsg.GetFragmentCount())
+	idx := int(dmsg.GetFragmentIndex())
+	if n < 2 || n > MaxFragments || idx >= n || len(dmsg.GetFragmentGroup()) == 0 {
+		p.log.Infof("dropping invalid fragment %d of %d from %s", idx, n, dmsg.GetFrom())
+		count(&p.stats.DroppedFragments)
+		return nil, nil, false
+	}
+
+	origin := string(dmsg.GetFrom())
+	key := origin + string(dmsg.GetFragmentGroup())
+	g, ok := p.fragments.groups[key]
+	if !ok {
+		if p.fragments.origins[origin] >= maxOriginFragmentGroups {
+			p.dropOldestGroup(func(g *fragmentGroup) bool { return g.origin == origin })
+		} else if len(p.fragments.groups) >= maxFragmentGroups {
+			p.dropOldestGroup(func(*fragmentGroup) bool { return true })
+		}
+
+		g = &fragmentGroup{
+			origin:  origin,
+			parts:   make([][]byte, n),
+			have:    make([]bool, n),
+			created: time.Now(),
+		}
+		p.fragments.groups[key] = g
+		p.fragments.origins[origin]++
+		if p.fragments.expire == nil {
+			p.fragments.expire = time.After(p.fragments.timeout)
+		}
+	}
+
+	if len(g.parts) != n || g.have[idx] {
+		p.log.Infof("dropping conflicting fragment %d of %d from %s", idx, n, dmsg.GetFrom())
+		count(&p.stats.DroppedFragments)
+		return nil, nil, false
+	}
+
+	g.parts[idx] = dmsg.GetData()
+	g.held = append(g.held, heldFragment{from: from, pmsg: pmsg})
+	g.have[idx] = true
+	g.count++
+	g.size += len(dmsg.GetData())
+	if g.size > MaxFragments*p.fragments.size {
+		p.log.Infof("dropping fragmented message from %s: too large", dmsg.GetFrom())
+		p.removeGroup(key, g)
+		atomic.AddUint64(&p.stats.DroppedFragments, uint64(g.count))
+		return nil, nil, false
+	}
+
+	if g.count < n {
+		return nil, nil, false
+	}
+
+	p.removeGroup(key, g)
+	data := make([]byte, 0, g.size)
+	for _, part := range g.parts {
+		data = append(data, part...)
+	}
+
+	return &pb.Message{
+		From:     dmsg.GetFrom(),
+		Data:     data,
+		Seqno:    dmsg.GetFragmentGroup(),
+		TopicIDs: dmsg.GetTopicIDs(),
+	}, g.held, true
+}
+
+// removeGroup forgets about the fragments of a message.
+// Only called from processLoop.
+func (p *PubSub) removeGroup(key string, g *fragmentGroup) {
+	delete(p.fragments.groups, key)
+	if p.fragments.origins[g.origin]--; p.fragments.origins[g.origin] == 0 {
+		delete(p.fragments.origins, g.origin)
+	}
+}
+
+// dropOldestGroup drops the fragments of the oldest incomplete message
+// matching match, to make room for another one.
+// Only called from processLoop.
+func (p *PubSub) dropOldestGroup(match func(*fragmentGroup) bool) {
+	var oldest *fragmentGroup
+	var oldestKey string
+	for key, g := range p.fragments.groups {
+		if match(g) && (oldest == nil || g.created.Before(oldest.created)) {
+			oldest, oldestKey = g, key
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	p.log.Infof("dropping %d of %d fragments of a message from %s: too many incomplete messages", oldest.count, len(oldest.parts), peer.ID(oldest.origin))
+	p.removeGroup(oldestKey, oldest)
+	atomic.AddUint64(&p.stats.DroppedFragments, uint64(oldest.count))
+}
+
+// expireFragments drops the fragments of messages not completed in time.
+// Only called from processLoop.
+func (p *PubSub) expireFragments() {
+	p.fragments.expire = nil
+
+	now := time.Now()
+	var next time.Duration
+	for key, g := range p.fragments.groups {
+		left := p.fragments.timeout - now.Sub(g.created)
+		if left > 0 {
+			if next == 0 || left < next {
+				next = left
+			}
+			continue
+		}
+
+		p.log.Infof("dropping %d of %d fragments of an incomplete message", g.count, len(g.parts))
+		p.removeGroup(key, g)
+		atomic.AddUint64(&p.stats.DroppedFragments, uint64(g.count))
+	}
+
+	if next > 0 {
+		p.fragments.expire = time.After(next)
+	}
+}
+
+// handleFragment stores a fragment we haven't seen before, and validates,
+// delivers and relays its message once it is complete. dmsg is the
+// decrypted pmsg. It returns the number of peers the fragments were queued
+// to, which is 0 until the message is complete.
+// Only called from processLoop.
+func (p *PubSub) handleFragment(from peer.ID, pmsg, dmsg *pb.Message, to map[peer.ID]struct{}, received time.Time) (int, error) {
+	whole, held, ok := p.addFragment(from, pmsg, dmsg)
+	if !ok {
+		return 0, nil
+	}
+
+	score := p.scoreOf(from)
+	if !p.validate(from, whole) {
+		count(&p.stats.DroppedValidation)
+		p.metrics.validationFailure()
+		if score != nil {
+			score.Invalid++
+		}
+		return 0, ErrValidationFailed
+	}
+
+	// the peer completing a message gets the credit for it
+	if score != nil {
+		score.Delivered++
+	}
+
+	p.observe(whole, received)
+	p.deliverMessage(from, whole, received)
+
+	var n int
+	for _, f := range held {
+		sent, err := p.publishMessage(f.from, f.pmsg, to)
+		if err != nil {
+			p.log.Error("publish message: ", err)
+		}
+		if sent > n {
+			n = sent
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,100 @@
+package floodsub
+
+import (
+	"fmt"
+)
+
+// Logger is what a PubSub logs to. The loggers of go-log implement it.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warning(args ...interface{})
+	Warningf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	// LogDebug is for details of how messages and peers are handled
+	LogDebug LogLevel = iota
+	// LogInfo is for messages, subscriptions and events being dropped
+	LogInfo
+	// LogWarning is for misbehaving peers and failing streams
+	LogWarning
+	// LogError is for failures of our own, always passed on by FilterLogger
+	LogError
+)
+
+// WithLogger makes the PubSub log to l instead of the "floodsub" logger of
+// go-log, e.g. to route its messages into the logging of the application,
+// or to quiet it down with FilterLogger.
+func WithLogger(l Logger) Option {
+	return func(p *PubSub) error {
+		if l == nil {
+			return fmt.Errorf("logger must not be nil")
+		}
+
+		p.log = l
+		return nil
+	}
+}
+
+// FilterLogger returns a Logger passing the messages of at least the given
+// level on to l, and discarding the others.
+func FilterLogger(l Logger, min LogLevel) Logger {
+	return &filterLogger{l: l, min: min}
+}
+
+type filterLogger struct {
+	l   Logger
+	min LogLevel
+}
+
+func (f *filterLogger) Debug(args ...interface{}) {
+	if f.min <= LogDebug {
+		f.l.Debug(args...)
+	}
+}
+
+func (f *filterLogger) Debugf(format string, args ...interface{}) {
+	if f.min <= LogDebug {
+		f.l.Debugf(format, args...)
+	}
+}
+
+func (f *filterLogger) Info(args ...interface{}) {
+	if f.min <= LogInfo {
+		f.l.Info(args...)
+	}
+}
+
+func (f *filterLogger) Infof(format string, args ...interface{}) {
+	if f.min <= LogInfo {
+		f.l.Infof(format, args...)
+	}
+}
+
+func (f *filterLogger) Warning(args ...interface{}) {
+	if f.min <= LogWarning {
+		f.l.Warning(args...)
+	}
+}
+
+func (f *filterLogger) Warningf(format string, args ...interface{}) {
+	if f.min <= LogWarning {
+		f.l.Warningf(format, args...)
+	}
+}
+
+func (f *filterLogger) Error(args ...interface{}) {
+	f.l.Error(args...)
+}
+
+func (f *filterLogger) Errorf(format string, args ...interface{}) {
+	f.l.Errorf(format, args...)
+}
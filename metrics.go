@@ -0,0 +1,201 @@
+package floodsub
+
+import (
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the prometheus collectors of a PubSub. All methods are safe
+// to call on a nil *metrics, which is used when metrics are disabled.
+type metrics struct {
+	peers              prometheus.Gauge
+	topics             prometheus.Gauge
+	topicSubscribers   *prometheus.GaugeVec
+	messagesIn         prometheus.Counter
+	messagesOut        prometheus.Counter
+	validationFailures prometheus.Counter
+	sendsThrottled     prometheus.Counter
+	eventDuration      *prometheus.HistogramVec
+	incomingQueue      prometheus.Gauge
+	incomingCapacity   prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		peers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "floodsub",
+			Name:      "peers",
+			Help:      "Number of peers we have a pubsub stream with.",
+		}),
+		topics: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "floodsub",
+			Name:      "topics",
+			Help:      "Number of topics we are subscribed to.",
+		}),
+		topicSubscribers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "floodsub",
+			Name:      "topic_subscriptions",
+			Help:      "Number of local subscriptions per topic.",
+		}, []string{"topic"}),
+		messagesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "floodsub",
+			Name:      "messages_in_total",
+			Help:      "Number of messages received from peers.",
+		}),
+		messagesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "floodsub",
+			Name:      "messages_out_total",
+			Help:      "Number of messages sent to peers.",
+		}),
+		validationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "floodsub",
+			Name:      "validation_failures_total",
+			Help:      "Number of messages which failed topic validation.",
+		}),
+		sendsThrottled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "floodsub",
+			Name:      "sends_throttled_total",
+			Help:      "Number of writes to peers which waited for a send slot.",
+		}),
+		eventDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "floodsub",
+			Name:      "event_loop_duration_seconds",
+			Help:      "Time the event loop took to handle RPCs and publish requests.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"event"}),
+		incomingQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "floodsub",
+			Name:      "incoming_queue_length",
+			Help:      "Number of RPCs from peers waiting for the event loop.",
+		}),
+		incomingCapacity: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "floodsub",
+			Name:      "incoming_queue_capacity",
+			Help:      "Number of RPCs from peers which can wait for the event loop.",
+		}),
+	}
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.peers,
+		m.topics,
+		m.topicSubscribers,
+		m.messagesIn,
+		m.messagesOut,
+		m.validationFailures,
+		m.sendsThrottled,
+		m.eventDuration,
+		m.incomingQueue,
+		m.incomingCapacity,
+	}
+}
+
+// WithMetricsRegisterer registers prometheus metrics of the PubSub with reg:
+// gauges for the number of peers, subscribed topics and local subscriptions
+// per topic, counters for messages in and out, validation failures and
+// throttled sends, and the load of the event loop: how long it takes to
+// handle RPCs and publish requests, and how many RPCs wait for it. An
+// incoming queue staying close to its capacity means the event loop can't
+// keep up.
+// Note that the per-topic gauge has one series per topic we subscribe to.
+func WithMetricsRegisterer(reg prometheus.Registerer) Option {
+	return func(p *PubSub) error {
+		m := newMetrics()
+		cs := m.collectors()
+		for i, c := range cs {
+			err := reg.Register(c)
+			if err != nil {
+				// leave reg as we found it, so registering again works
+				for _, r := range cs[:i] {
+					reg.Unregister(r)
+				}
+				return err
+			}
+		}
+
+		p.metrics = m
+		return nil
+	}
+}
+
+func (m *metrics) setPeers(n int) {
+	if m == nil {
+		return
+	}
+	m.peers.Set(float64(n))
+}
+
+func (m *metrics) setTopicSubscribers(topic string, topics, n int) {
+	if m == nil {
+		return
+	}
+
+	m.topics.Set(float64(topics))
+	if n == 0 {
+		m.topicSubscribers.DeleteLabelValues(topic)
+		return
+	}
+	m.topicSubscribers.WithLabelValues(topic).Set(float64(n))
+}
+
+// reset zeroes the gauges once the PubSub has shut down
+func (m *metrics) reset() {
+	if m == nil {
+		return
+	}
+	m.peers.Set(0)
+	m.topics.Set(0)
+	m.topicSubscribers.Reset()
+	m.incomingQueue.Set(0)
+}
+
+func (m *metrics) messageIn() {
+	if m == nil {
+		return
+	}
+	m.messagesIn.Inc()
+}
+
+func (m *metrics) messageOut() {
+	if m == nil {
+		return
+	}
+	m.messagesOut.Inc()
+}
+
+func (m *metrics) validationFailure() {
+	if m == nil {
+		return
+	}
+	m.validationFailures.Inc()
+}
+
+func (m *metrics) sendThrottled() {
+	if m == nil {
+		return
+	}
+	m.sendsThrottled.Inc()
+}
+
+func (m *metrics) observeEvent(event string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.eventDuration.WithLabelValues(event).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) setIncomingQueue(n int) {
+	if m == nil {
+		return
+	}
+	m.incomingQueue.Set(float64(n))
+}
+
+func (m *metrics) setIncomingCapacity(n int) {
+	if m == nil {
+		return
+	}
+	m.incomingCapacity.Set(float64(n))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -18,20 +19,27 @@ func (p *PubSubNotif) ClosedStream(n inet.Network, s inet.Stream) {
 }
 
 func (p *PubSubNotif) Connected(n inet.Network, c inet.Conn) {
-	s, err := p.host.NewStream(context.Background(), c.RemotePeer(), ID)
+	(*PubSub)(p).openStream(c.RemotePeer())
+}
+
+// openStream opens a stream to pid and hands it to processLoop.
+func (p *PubSub) openStream(pid peer.ID) {
+	h := p.Host()
+	s, err := h.NewStream(context.Background(), pid, p.protocols...)
 	if err != nil {
-		log.Warning("opening new stream to peer: ", err, c.LocalPeer(), c.RemotePeer())
+		p.log.Warning("opening new stream to peer: ", err, h.ID(), pid)
 		return
 	}
 
 	select {
 	case p.newPeers <- s:
-	case <-p.ctx.Done():
+	case <-p.done:
 		s.Close()
 	}
 }
 
 func (p *PubSubNotif) Disconnected(n inet.Network, c inet.Conn) {
+	(*PubSub)(p).forgetDial(c.RemotePeer())
 }
 
 func (p *PubSubNotif) Listen(n inet.Network, _ ma.Multiaddr) {
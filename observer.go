@@ -0,0 +1,77 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+)
+
+// messageObserverBuffer is the number of messages queued for the message
+// observer before further messages are dropped
+const messageObserverBuffer = 128
+
+// messageObserver calls fn on its own goroutine for the messages queued on
+// queue, so a slow observer can't stall processLoop
+type messageObserver struct {
+	fn    func(*Message)
+	queue chan *Message
+}
+
+// WithMessageObserver calls fn once for every valid message we see, whether
+// we published, forwarded or delivered it, and regardless of our
+// subscriptions. fn is called from a single goroutine in the order the
+// messages were validated. If fn falls behind by more than
+// messageObserverBuffer messages, further messages aren't observed and are
+// counted in Stats.DroppedObserverFull.
+func WithMessageObserver(fn func(*Message)) Option {
+	return func(p *PubSub) error {
+		if fn == nil {
+			return fmt.Errorf("message observer must not be nil")
+		}
+
+		p.observer.fn = fn
+		return nil
+	}
+}
+
+// startObserver starts the goroutine calling the message observer, if any.
+func (p *PubSub) startObserver() {
+	if p.observer.fn == nil {
+		return
+	}
+
+	p.observer.queue = make(chan *Message, messageObserverBuffer)
+	go func(fn func(*Message), queue <-chan *Message) {
+		for msg := range queue {
+			fn(msg)
+		}
+	}(p.observer.fn, p.observer.queue)
+}
+
+// observe queues msg for the message observer, if any.
+// Only called from processLoop.
+func (p *PubSub) observe(msg *pb.Message, received time.Time) {
+	if p.observer.queue == nil {
+		return
+	}
+
+	select {
+	case p.observer.queue <- &Message{Message: msg, ReceivedAt: received}:
+	default:
+		p.log.Infof("dropping message for observer: queue full")
+		count(&p.stats.DroppedObserverFull)
+	}
+}
+
+// stopObserver stops the goroutine calling the message observer once it
+// has called it for the messages already queued.
+// Only called from processLoop.
+func (p *PubSub) stopObserver() {
+	if p.observer.queue == nil {
+		return
+	}
+
+	close(p.observer.queue)
+	p.observer.queue = nil
+}
@@ -0,0 +1,168 @@
+package floodsub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ordering holds the settings and state of ordered delivery
+type ordering struct {
+	// window is how long a message waits for the ones preceding it, 0 if
+	// ordered delivery is disabled
+	window time.Duration
+
+	origins map[peer.ID]*originQueue
+
+	// flush fires at flushAt, when buffered messages are due or idle
+	// origins are to be forgotten, and is nil while we track no origins
+	flush   <-chan time.Time
+	flushAt time.Time
+}
+
+// originQueue holds the messages of an origin waiting for their
+// predecessors
+type originQueue struct {
+	// last is the seqno of the last message delivered, if started
+	last    uint64
+	started bool
+
+	pending map[uint64]*pendingMsg
+	active  time.Time
+}
+
+type pendingMsg struct {
+	msg      *pb.Message
+	received time.Time
+	due      time.Time
+}
+
+// WithOrderedDelivery delivers the messages of each origin to our
+// subscribers in seqno order. A message arriving before the one preceding
+// it is held back for up to window; once that passes, the messages held
+// back are delivered and the missing ones are given up on. Messages
+// arriving after a later one was delivered are dropped and counted in
+// Stats.DroppedOutOfOrder. Messages of an origin we haven't seen before
+// are held back for window, as we don't know where its sequence starts.
+// Seqnos of an origin are shared by all its topics, so messages on topics
+// we don't subscribe to show up as gaps delaying delivery by window. Our
+// own messages are delivered right away.
+func WithOrderedDelivery(window time.Duration) Option {
+	return func(p *PubSub) error {
+		if window <= 0 {
+			return fmt.Errorf("ordered delivery window must be positive, got %s", window)
+		}
+
+		p.ordering.window = window
+		return nil
+	}
+}
+
+// deliverMessage delivers a message received from the peer from to our
+// subscribers, in order if ordered delivery is enabled.
+// Only called from processLoop.
+func (p *PubSub) deliverMessage(from peer.ID, msg *pb.Message, received time.Time) {
+	if from == p.host.ID() && p.noLoopback {
+		return
+	}
+
+	origin := peer.ID(msg.GetFrom())
+	if p.ordering.window == 0 || origin == p.host.ID() || len(msg.GetSeqno()) != 8 {
+		p.notifySubs(msg, received)
+		return
+	}
+
+	q, ok := p.ordering.origins[origin]
+	if !ok {
+		q = &originQueue{pending: make(map[uint64]*pendingMsg)}
+		p.ordering.origins[origin] = q
+	}
+
+	now := time.Now()
+	q.active = now
+
+	seqno := binary.BigEndian.Uint64(msg.GetSeqno())
+	if q.started && seqno <= q.last {
+		p.log.Infof("dropping message %d from %s: arrived after message %d", seqno, origin, q.last)
+		count(&p.stats.DroppedOutOfOrder)
+		return
+	}
+
+	due := now.Add(p.ordering.window)
+	q.pending[seqno] = &pendingMsg{msg: msg, received: received, due: due}
+	p.drainOrigin(q, now)
+
+	if p.ordering.flush == nil || due.Before(p.ordering.flushAt) {
+		p.scheduleOrderingFlush(now, due)
+	}
+}
+
+// scheduleOrderingFlush makes flushOrdering run at t.
+// Only called from processLoop.
+func (p *PubSub) scheduleOrderingFlush(now, t time.Time) {
+	p.ordering.flush = time.After(t.Sub(now))
+	p.ordering.flushAt = t
+}
+
+// drainOrigin delivers the pending messages of q which are next in sequence
+// or have waited long enough.
+// Only called from processLoop.
+func (p *PubSub) drainOrigin(q *originQueue, now time.Time) {
+	for len(q.pending) > 0 {
+		var next uint64
+		first := true
+		for seqno := range q.pending {
+			if first || seqno < next {
+				next, first = seqno, false
+			}
+		}
+
+		pm := q.pending[next]
+		if (!q.started || next != q.last+1) && now.Before(pm.due) {
+			return
+		}
+
+		delete(q.pending, next)
+		q.last, q.started = next, true
+		p.notifySubs(pm.msg, pm.received)
+	}
+}
+
+// flushOrdering delivers the messages which waited long enough for their
+// predecessors, and forgets about origins idle for longer than the seen
+// message cache remembers their messages.
+// Only called from processLoop.
+func (p *PubSub) flushOrdering() {
+	p.ordering.flush = nil
+
+	now := time.Now()
+	var next time.Time
+	for origin, q := range p.ordering.origins {
+		p.drainOrigin(q, now)
+
+		if len(q.pending) == 0 {
+			if now.Sub(q.active) > p.seenMessagesTTL {
+				delete(p.ordering.origins, origin)
+				continue
+			}
+			if due := q.active.Add(p.seenMessagesTTL); next.IsZero() || due.Before(next) {
+				next = due
+			}
+			continue
+		}
+
+		for _, pm := range q.pending {
+			if next.IsZero() || pm.due.Before(next) {
+				next = pm.due
+			}
+		}
+	}
+
+	if !next.IsZero() {
+		p.scheduleOrderingFlush(now, next)
+	}
+}
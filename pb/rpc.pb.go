@@ -97,9 +97,11 @@ func (x *TopicDescriptor_EncOpts_EncMode) UnmarshalJSON(data []byte) error {
 }
 
 type RPC struct {
-	Subscriptions    []*RPC_SubOpts `protobuf:"bytes,1,rep,name=subscriptions" json:"subscriptions,omitempty"`
-	Publish          []*Message     `protobuf:"bytes,2,rep,name=publish" json:"publish,omitempty"`
-	XXX_unrecognized []byte         `json:"-"`
+	Subscriptions    []*RPC_SubOpts      `protobuf:"bytes,1,rep,name=subscriptions" json:"subscriptions,omitempty"`
+	Publish          []*Message          `protobuf:"bytes,2,rep,name=publish" json:"publish,omitempty"`
+	Hello            []byte              `protobuf:"bytes,3,opt,name=hello" json:"hello,omitempty"`
+	Exchange         []*RPC_PeerExchange `protobuf:"bytes,4,rep,name=exchange" json:"exchange,omitempty"`
+	XXX_unrecognized []byte              `json:"-"`
 }
 
 func (m *RPC) Reset()         { *m = RPC{} }
@@ -120,6 +122,20 @@ func (m *RPC) GetPublish() []*Message {
 	return nil
 }
 
+func (m *RPC) GetHello() []byte {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
+func (m *RPC) GetExchange() []*RPC_PeerExchange {
+	if m != nil {
+		return m.Exchange
+	}
+	return nil
+}
+
 type RPC_SubOpts struct {
 	Subscribe        *bool   `protobuf:"varint,1,opt,name=subscribe" json:"subscribe,omitempty"`
 	Topicid          *string `protobuf:"bytes,2,opt,name=topicid" json:"topicid,omitempty"`
@@ -144,11 +160,48 @@ func (m *RPC_SubOpts) GetTopicid() string {
 	return ""
 }
 
+type RPC_PeerExchange struct {
+	Topicid          *string  `protobuf:"bytes,1,opt,name=topicid" json:"topicid,omitempty"`
+	PeerID           []byte   `protobuf:"bytes,2,opt,name=peerID" json:"peerID,omitempty"`
+	Addrs            [][]byte `protobuf:"bytes,3,rep,name=addrs" json:"addrs,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *RPC_PeerExchange) Reset()         { *m = RPC_PeerExchange{} }
+func (m *RPC_PeerExchange) String() string { return proto.CompactTextString(m) }
+func (*RPC_PeerExchange) ProtoMessage()    {}
+
+func (m *RPC_PeerExchange) GetTopicid() string {
+	if m != nil && m.Topicid != nil {
+		return *m.Topicid
+	}
+	return ""
+}
+
+func (m *RPC_PeerExchange) GetPeerID() []byte {
+	if m != nil {
+		return m.PeerID
+	}
+	return nil
+}
+
+func (m *RPC_PeerExchange) GetAddrs() [][]byte {
+	if m != nil {
+		return m.Addrs
+	}
+	return nil
+}
+
 type Message struct {
 	From             []byte   `protobuf:"bytes,1,opt,name=from" json:"from,omitempty"`
 	Data             []byte   `protobuf:"bytes,2,opt,name=data" json:"data,omitempty"`
 	Seqno            []byte   `protobuf:"bytes,3,opt,name=seqno" json:"seqno,omitempty"`
 	TopicIDs         []string `protobuf:"bytes,4,rep,name=topicIDs" json:"topicIDs,omitempty"`
+	Ttl              *uint32  `protobuf:"varint,5,opt,name=ttl" json:"ttl,omitempty"`
+	FragmentGroup    []byte   `protobuf:"bytes,6,opt,name=fragmentGroup" json:"fragmentGroup,omitempty"`
+	FragmentIndex    *uint32  `protobuf:"varint,7,opt,name=fragmentIndex" json:"fragmentIndex,omitempty"`
+	FragmentCount    *uint32  `protobuf:"varint,8,opt,name=fragmentCount" json:"fragmentCount,omitempty"`
+	Compression      *string  `protobuf:"bytes,9,opt,name=compression" json:"compression,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -184,6 +237,41 @@ func (m *Message) GetTopicIDs() []string {
 	return nil
 }
 
+func (m *Message) GetTtl() uint32 {
+	if m != nil && m.Ttl != nil {
+		return *m.Ttl
+	}
+	return 0
+}
+
+func (m *Message) GetFragmentGroup() []byte {
+	if m != nil {
+		return m.FragmentGroup
+	}
+	return nil
+}
+
+func (m *Message) GetFragmentIndex() uint32 {
+	if m != nil && m.FragmentIndex != nil {
+		return *m.FragmentIndex
+	}
+	return 0
+}
+
+func (m *Message) GetFragmentCount() uint32 {
+	if m != nil && m.FragmentCount != nil {
+		return *m.FragmentCount
+	}
+	return 0
+}
+
+func (m *Message) GetCompression() string {
+	if m != nil && m.Compression != nil {
+		return *m.Compression
+	}
+	return ""
+}
+
 // topicID = hash(topicDescriptor); (not the topic.name)
 type TopicDescriptor struct {
 	Name             *string                   `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
@@ -268,6 +356,7 @@ func (m *TopicDescriptor_EncOpts) GetKeyHashes() [][]byte {
 func init() {
 	proto.RegisterType((*RPC)(nil), "floodsub.pb.RPC")
 	proto.RegisterType((*RPC_SubOpts)(nil), "floodsub.pb.RPC.SubOpts")
+	proto.RegisterType((*RPC_PeerExchange)(nil), "floodsub.pb.RPC.PeerExchange")
 	proto.RegisterType((*Message)(nil), "floodsub.pb.Message")
 	proto.RegisterType((*TopicDescriptor)(nil), "floodsub.pb.TopicDescriptor")
 	proto.RegisterType((*TopicDescriptor_AuthOpts)(nil), "floodsub.pb.TopicDescriptor.AuthOpts")
@@ -0,0 +1,95 @@
+package floodsub
+
+import (
+	"context"
+
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PeerInfo describes the connection our session with a peer runs over
+type PeerInfo struct {
+	// LocalAddr is our address of the connection
+	LocalAddr ma.Multiaddr
+	// RemoteAddr is the address of the peer on the connection, telling the
+	// transport it is reached over
+	RemoteAddr ma.Multiaddr
+	// DialedByPubSub is set if the PubSub dialed the connection itself,
+	// for direct peers and peers found with peer exchange. It is not the
+	// direction of the connection: the connections of our libp2p version
+	// don't tell who dialed them, so connections made by the host or the
+	// application report false whichever side dialed.
+	DialedByPubSub bool
+}
+
+type peerInfoReq struct {
+	peer peer.ID
+	resp chan peerInfoResp
+}
+
+type peerInfoResp struct {
+	info PeerInfo
+	ok   bool
+}
+
+// PeerInfo returns the connection details of our session with pid. The bool
+// is false if we have no session with pid.
+func (p *PubSub) PeerInfo(pid peer.ID) (PeerInfo, bool) {
+	out := make(chan peerInfoResp, 1)
+	select {
+	case p.getPeerInfo <- &peerInfoReq{peer: pid, resp: out}:
+	case <-p.done:
+		return PeerInfo{}, false
+	}
+	resp := <-out
+	return resp.info, resp.ok
+}
+
+// dial connects h to pi, recording that we dialed the connection unless we
+// were connected to pi already.
+func (p *PubSub) dial(ctx context.Context, h host.Host, pi pstore.PeerInfo) error {
+	if h.Network().Connectedness(pi.ID) == inet.Connected {
+		return nil
+	}
+
+	p.dialLk.Lock()
+	p.dialed[pi.ID] = struct{}{}
+	p.dialLk.Unlock()
+
+	err := h.Connect(ctx, pi)
+	if err != nil {
+		p.forgetDial(pi.ID)
+	}
+	return err
+}
+
+// forgetDial forgets that we dialed pid, and returns whether we did.
+func (p *PubSub) forgetDial(pid peer.ID) bool {
+	p.dialLk.Lock()
+	defer p.dialLk.Unlock()
+
+	_, ok := p.dialed[pid]
+	delete(p.dialed, pid)
+	return ok
+}
+
+// newPeerInfo returns the details of a session running over s, which
+// replaces the session described by prev, if any.
+func (p *PubSub) newPeerInfo(s inet.Stream, prev PeerInfo) PeerInfo {
+	c := s.Conn()
+	info := PeerInfo{
+		LocalAddr:      c.LocalMultiaddr(),
+		RemoteAddr:     c.RemoteMultiaddr(),
+		DialedByPubSub: p.forgetDial(c.RemotePeer()),
+	}
+
+	// a new stream over the connection we dialed, e.g. replacing the
+	// stream to a direct peer
+	if prev.DialedByPubSub && prev.RemoteAddr != nil && prev.RemoteAddr.Equal(info.RemoteAddr) {
+		info.DialedByPubSub = true
+	}
+	return info
+}
@@ -0,0 +1,52 @@
+package floodsub
+
+import (
+	"strings"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+)
+
+// TopicWildcard terminates topic IDs which stand for all topics starting
+// with the preceding prefix. A subscription to "sensors/room1/*" receives
+// messages published on "sensors/room1/temp" and "sensors/room1/humidity".
+// Peers announcing such a topic ID get all messages with a matching topic
+// forwarded to them.
+//
+// Wildcards are a convention of this implementation, not of the floodsub
+// protocol. Floodsub nodes without wildcard support treat "sensors/room1/*"
+// as a literal topic and only relay messages published on exactly that
+// topic, so prefix subscriptions only work across relays that all support
+// them. It also means topics whose name ends in TopicWildcard can't be
+// subscribed to as exact topics anymore.
+const TopicWildcard = "*"
+
+// SubscribePrefix returns a new Subscription for all topics starting with
+// prefix. It is equivalent to subscribing to prefix + TopicWildcard.
+func (p *PubSub) SubscribePrefix(prefix string, opts ...SubOpt) (*Subscription, error) {
+	return p.Subscribe(prefix+TopicWildcard, opts...)
+}
+
+// wildcardPrefix returns the prefix a wildcard topic ID stands for, and
+// whether topic is a wildcard at all.
+func wildcardPrefix(topic string) (string, bool) {
+	if !strings.HasSuffix(topic, TopicWildcard) {
+		return "", false
+	}
+	return strings.TrimSuffix(topic, TopicWildcard), true
+}
+
+// msgHasTopicPrefix returns whether one of the topics of msg starts with prefix
+func msgHasTopicPrefix(msg *pb.Message, prefix string) bool {
+	_, ok := msgTopicWithPrefix(msg, prefix)
+	return ok
+}
+
+// msgTopicWithPrefix returns the first topic of msg starting with prefix
+func msgTopicWithPrefix(msg *pb.Message, prefix string) (string, bool) {
+	for _, t := range msg.GetTopicIDs() {
+		if strings.HasPrefix(t, prefix) {
+			return t, true
+		}
+	}
+	return "", false
+}
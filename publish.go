@@ -0,0 +1,249 @@
+package floodsub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PublishTo publishes data under the given topic, but only sends it to those
+// of the given peers we are connected to and which are subscribed to the
+// topic. Other peers in the list are skipped. Note that the recipients relay
+// the message to their own peers as usual.
+func (p *PubSub) PublishTo(peers []peer.ID, topic string, data []byte) error {
+	msgs, err := p.newFragments([]string{topic}, data, nil)
+	if err != nil {
+		return err
+	}
+
+	to := make(map[peer.ID]struct{}, len(peers))
+	for _, pid := range peers {
+		to[pid] = struct{}{}
+	}
+
+	return p.publishFragments(msgs, to)
+}
+
+// PublishAs publishes data under the given topic on behalf of another
+// author, e.g. for a gateway bridging messages from outside the network.
+// The message carries from and seqno instead of our ID and next seqno, so
+// it is deduplicated as the author's message wherever it is published, and
+// the caller must keep seqno unique for the author. Publishing as ourselves
+// would clash with our own seqnos and is rejected unless allowed with
+// WithPublishAsHost.
+func (p *PubSub) PublishAs(from peer.ID, seqno []byte, topic string, data []byte) error {
+	if _, err := peer.IDFromBytes([]byte(from)); err != nil {
+		return fmt.Errorf("cannot publish message: invalid author: %s", err)
+	}
+	if len(seqno) == 0 {
+		return fmt.Errorf("cannot publish message: empty seqno")
+	}
+	if err := p.checkSeqno(seqno); err != nil {
+		return fmt.Errorf("cannot publish message: %s", err)
+	}
+	if from == p.Host().ID() && !p.publishAsHost {
+		return fmt.Errorf("cannot publish message as the local host")
+	}
+
+	msg, err := p.newMessageWithSeqno([]string{topic}, data, nil, seqno)
+	if err != nil {
+		return err
+	}
+	msg.From = []byte(from)
+
+	// the author's ID may be longer than ours
+	if err := p.checkMessageSize(msg.Message); err != nil {
+		return err
+	}
+
+	return p.pushPublish(&publishReq{msg: msg})
+}
+
+// PublishRaw publishes a message built elsewhere, e.g. by a bridge which
+// decoded it from another source, as it is. Unlike PublishAs it is neither
+// compressed, encrypted nor fragmented, and the publish rates of its topics
+// don't apply, but it is still deduplicated, validated and forwarded like
+// any other message. The message must carry a valid author, a seqno and
+// topics, and must not be modified once published. Publishing a message
+// authored by us is rejected unless allowed with WithPublishAsHost.
+func (p *PubSub) PublishRaw(pmsg *pb.Message) error {
+	if pmsg == nil {
+		return fmt.Errorf("cannot publish message: nil message")
+	}
+
+	from, err := peer.IDFromBytes(pmsg.GetFrom())
+	if err != nil {
+		return fmt.Errorf("cannot publish message: invalid author: %s", err)
+	}
+	if len(pmsg.GetSeqno()) == 0 {
+		return fmt.Errorf("cannot publish message: empty seqno")
+	}
+	if err := p.checkSeqno(pmsg.GetSeqno()); err != nil {
+		return fmt.Errorf("cannot publish message: %s", err)
+	}
+	if err := p.checkTopics(pmsg.GetTopicIDs()); err != nil {
+		return fmt.Errorf("cannot publish message: %s", err)
+	}
+	if from == p.Host().ID() && !p.publishAsHost {
+		return fmt.Errorf("cannot publish message as the local host")
+	}
+	if err := p.checkMessageSize(pmsg); err != nil {
+		return err
+	}
+
+	return p.pushPublish(&publishReq{msg: &Message{Message: pmsg}})
+}
+
+// WithPublishAsHost(true) allows PublishAs and PublishRaw to publish messages
+// with our own ID as their author. The caller is then responsible for keeping
+// their seqnos apart from those we pick for our own messages.
+func WithPublishAsHost(allowed bool) Option {
+	return func(p *PubSub) error {
+		p.publishAsHost = allowed
+		return nil
+	}
+}
+
+// PublishWithTTL publishes data under the given topic, limiting how far the
+// message travels. Our peers receive the message with the given TTL, and
+// every peer relaying it decrements it, so a TTL of 0 reaches only our
+// direct peers and a TTL of n travels at most n+1 hops.
+func (p *PubSub) PublishWithTTL(topic string, data []byte, ttl uint32) error {
+	msgs, err := p.newFragments([]string{topic}, data, &ttl)
+	if err != nil {
+		return err
+	}
+
+	return p.publishFragments(msgs, nil)
+}
+
+// PublishValidated publishes data under the given topic like Publish, but
+// waits for the validator registered for the topic to run, and returns
+// ErrValidationFailed if the message failed it. The message is only
+// validated once.
+func (p *PubSub) PublishValidated(topic string, data []byte) error {
+	msg, err := p.newMessage([]string{topic}, data, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.publishAndWait(msg)
+	return err
+}
+
+// PublishCount publishes data under the given topic like PublishValidated,
+// and returns the number of peers the message was sent to. A count of 0
+// means none of our peers is subscribed to the topic, or their outbound
+// queues were full.
+func (p *PubSub) PublishCount(topic string, data []byte) (int, error) {
+	msg, err := p.newMessage([]string{topic}, data, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.publishAndWait(msg)
+}
+
+// PublishIfSubscribers publishes data under the given topic like Publish,
+// but only if we or any of our peers are subscribed to the topic; our own
+// subscriptions don't count with WithLocalLoopback(false). It returns
+// whether the message was published. Note that the message is built before
+// the check, so publishing too large a message fails regardless.
+func (p *PubSub) PublishIfSubscribers(topic string, data []byte) (bool, error) {
+	msg, err := p.newMessage([]string{topic}, data, nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := p.publishAndWaitReq(&publishReq{msg: msg, ifSubscribers: true})
+	if err != nil {
+		return false, err
+	}
+	return !res.skipped, res.err
+}
+
+// publishAndWait hands msg to processLoop and waits until it was published.
+func (p *PubSub) publishAndWait(msg *Message) (int, error) {
+	res, err := p.publishAndWaitReq(&publishReq{msg: msg})
+	if err != nil {
+		return 0, err
+	}
+	return res.peers, res.err
+}
+
+// publishAndWaitReq hands req to processLoop and waits for its outcome.
+func (p *PubSub) publishAndWaitReq(req *publishReq) (publishResult, error) {
+	req.resp = make(chan publishResult, 1)
+	err := p.pushPublish(req)
+	if err != nil {
+		return publishResult{}, err
+	}
+	return <-req.resp, nil
+}
+
+// DeliveryReport is the outcome of a message published with
+// PublishWithReceipt
+type DeliveryReport struct {
+	// Peers is the number of peers the message was queued to
+	Peers int
+	// Delivered is set if the message was handed to our own subscribers
+	Delivered bool
+	// Err is ErrValidationFailed if the message failed validation, in
+	// which case it was neither delivered nor sent
+	Err error
+}
+
+// PublishWithReceipt publishes data under the given topic like Publish, and
+// calls cb once the message was validated and queued to our peers. The
+// report is best-effort: a message queued to a peer may still be lost on
+// the way, and nothing tells whether any peer accepted it. cb is called
+// from the event loop of the PubSub, so it must be fast and must not call
+// into the PubSub. It isn't called if publishing fails before the message
+// reaches the event loop, in which case the error is returned.
+func (p *PubSub) PublishWithReceipt(topic string, data []byte, cb func(DeliveryReport)) error {
+	if cb == nil {
+		return fmt.Errorf("receipt callback must not be nil")
+	}
+
+	msg, err := p.newMessage([]string{topic}, data, nil)
+	if err != nil {
+		return err
+	}
+
+	return p.pushPublish(&publishReq{msg: msg, receipt: cb})
+}
+
+// PublishBatch publishes each of the payloads as a message under the given
+// topic, with consecutive seqnos. The messages are handed to the event loop
+// at once, which makes this cheaper than calling Publish for every payload,
+// but they are still delivered and deduplicated independently. If any of
+// the messages can't be built, e.g. because it is too large, none of them
+// is published.
+func (p *PubSub) PublishBatch(topic string, payloads [][]byte) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	// reserve all seqnos at once and share one allocation between them
+	n := uint64(len(payloads))
+	first := atomic.AddUint64(&p.counter, n) - n + 1
+	seqnos := make([]byte, 8*len(payloads))
+
+	msgs := make([]*Message, 0, len(payloads))
+	for i, data := range payloads {
+		seqno := seqnos[i*8 : i*8+8 : i*8+8]
+		binary.BigEndian.PutUint64(seqno, first+uint64(i))
+
+		msg, err := p.newMessageWithSeqno([]string{topic}, data, nil, seqno)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return p.pushPublish(&publishReq{batch: msgs})
+}
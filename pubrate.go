@@ -0,0 +1,131 @@
+package floodsub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrPublishRateExceeded is returned when publishing to a topic faster than
+// the rate set with WithTopicPublishRate allows
+var ErrPublishRateExceeded = errors.New("topic publish rate exceeded")
+
+// PublishRateMode selects what publishing beyond the rate set with
+// WithTopicPublishRate does
+type PublishRateMode int
+
+const (
+	// RejectOverRate makes publishing fail with ErrPublishRateExceeded
+	RejectOverRate PublishRateMode = iota
+	// BlockOverRate makes publishing wait until the rate allows the message
+	BlockOverRate
+)
+
+// publishRate is the limit on publishing to a topic
+type publishRate struct {
+	rate  float64
+	burst int
+	mode  PublishRateMode
+}
+
+// publishLimits holds the limits on publishing to topics. The limits are
+// only written by options, the buckets are guarded by lk as we publish from
+// any goroutine.
+type publishLimits struct {
+	limits map[string]publishRate
+
+	lk      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// WithTopicPublishRate limits how fast we publish to topic to msgsPerSec
+// messages on average, allowing bursts of up to burst messages. Each
+// fragment of a message counts as one message. mode selects whether
+// publishing beyond the limit fails or waits. The budget of a topic starts
+// over once we unsubscribe from it.
+func WithTopicPublishRate(topic string, msgsPerSec float64, burst int, mode PublishRateMode) Option {
+	return func(p *PubSub) error {
+		if msgsPerSec <= 0 {
+			return fmt.Errorf("publish rate must be positive, got %v", msgsPerSec)
+		}
+		if burst < 1 {
+			return fmt.Errorf("publish rate burst must be positive, got %d", burst)
+		}
+
+		p.pubLimits.limits[topic] = publishRate{rate: msgsPerSec, burst: burst, mode: mode}
+		return nil
+	}
+}
+
+// waitPublishRate takes a token for a message on the given topics from each
+// of their buckets. It fails if a topic rejecting messages over its rate has
+// no token left, and otherwise waits until all tokens are earned.
+func (p *PubSub) waitPublishRate(topics []string) error {
+	l := &p.pubLimits
+	if len(l.limits) == 0 {
+		return nil
+	}
+
+	l.lk.Lock()
+	now := time.Now()
+	for _, t := range topics {
+		r, ok := l.limits[t]
+		if !ok {
+			continue
+		}
+
+		b, ok := l.buckets[t]
+		if !ok {
+			b = &tokenBucket{tokens: float64(r.burst), last: now}
+			l.buckets[t] = b
+		}
+
+		b.refill(now, r.rate, r.burst)
+		if b.tokens < 1 && r.mode == RejectOverRate {
+			l.lk.Unlock()
+			return ErrPublishRateExceeded
+		}
+	}
+
+	// tokens below zero are reserved by waiting publishers
+	var wait time.Duration
+	for _, t := range topics {
+		r, ok := l.limits[t]
+		if !ok {
+			continue
+		}
+
+		b := l.buckets[t]
+		b.tokens--
+		if b.tokens < 0 {
+			if w := time.Duration(-b.tokens / r.rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	l.lk.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-p.done:
+		return p.closedErr()
+	}
+}
+
+// resetPublishRate forgets the budget of a topic we unsubscribed from.
+func (p *PubSub) resetPublishRate(topic string) {
+	l := &p.pubLimits
+	if _, ok := l.limits[topic]; !ok {
+		return
+	}
+
+	l.lk.Lock()
+	delete(l.buckets, topic)
+	l.lk.Unlock()
+}
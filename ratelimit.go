@@ -0,0 +1,102 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// rateLimit configures the per peer limit on received messages
+type rateLimit struct {
+	rate  float64
+	burst int
+
+	// blacklistAfter, if positive, is the number of dropped messages after
+	// which a peer gets blacklisted
+	blacklistAfter int
+}
+
+// tokenBucket tracks the message budget of one peer
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	// dropped counts the messages dropped because the bucket was empty
+	dropped int
+}
+
+// WithPeerRateLimit limits the number of messages we accept from each peer
+// to msgsPerSec on average, allowing bursts of up to burst messages.
+// Messages beyond the limit are dropped, neither delivered nor forwarded,
+// and counted in Stats.DroppedRateLimited.
+func WithPeerRateLimit(msgsPerSec float64, burst int) Option {
+	return func(p *PubSub) error {
+		if msgsPerSec <= 0 {
+			return fmt.Errorf("rate limit must be positive, got %v", msgsPerSec)
+		}
+		if burst < 1 {
+			return fmt.Errorf("rate limit burst must be positive, got %d", burst)
+		}
+
+		p.rateLimit.rate = msgsPerSec
+		p.rateLimit.burst = burst
+		return nil
+	}
+}
+
+// WithRateLimitBlacklist blacklists peers once n of their messages were
+// dropped by the limit set with WithPeerRateLimit.
+func WithRateLimitBlacklist(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("rate limit blacklist threshold must be positive, got %d", n)
+		}
+
+		p.rateLimit.blacklistAfter = n
+		return nil
+	}
+}
+
+// allowMessage takes a token from the bucket of pid and returns whether a
+// message from it may be processed.
+// Only called from processLoop.
+func (p *PubSub) allowMessage(pid peer.ID) bool {
+	if p.rateLimit.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	b, ok := p.limiters[pid]
+	if !ok {
+		b = &tokenBucket{tokens: float64(p.rateLimit.burst), last: now}
+		p.limiters[pid] = b
+	}
+
+	b.refill(now, p.rateLimit.rate, p.rateLimit.burst)
+	if b.tokens < 1 {
+		b.dropped++
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since the last refill at rate tokens per
+// second, up to burst tokens.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if max := float64(burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// exceededRateLimit returns whether pid dropped enough messages to be
+// blacklisted.
+// Only called from processLoop.
+func (p *PubSub) exceededRateLimit(pid peer.ID) bool {
+	b, ok := p.limiters[pid]
+	return ok && p.rateLimit.blacklistAfter > 0 && b.dropped >= p.rateLimit.blacklistAfter
+}
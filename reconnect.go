@@ -0,0 +1,82 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultReconnectAttempts is how often we try to reopen a failed stream to
+// a peer we are still connected to, unless configured otherwise with
+// WithReconnectBackoff
+const DefaultReconnectAttempts = 3
+
+// DefaultReconnectBackoff is how long we wait before the first attempt to
+// reopen a failed stream, unless configured otherwise with
+// WithReconnectBackoff
+const DefaultReconnectBackoff = time.Millisecond * 100
+
+// reconnectPolicy configures how we reopen failed streams
+type reconnectPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// WithReconnectBackoff sets how we reopen the stream to a peer after writing
+// to it failed although libp2p is still connected to the peer. We wait
+// backoff before the first attempt and double the wait after every failed
+// one, giving up after the given number of attempts. Once the stream is
+// open again, the peer gets our subscriptions like any new peer. 0 attempts
+// disable reconnecting. Defaults to DefaultReconnectAttempts and
+// DefaultReconnectBackoff.
+func WithReconnectBackoff(attempts int, backoff time.Duration) Option {
+	return func(p *PubSub) error {
+		if attempts < 0 {
+			return fmt.Errorf("reconnect attempts must not be negative, got %d", attempts)
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("reconnect backoff must be positive, got %s", backoff)
+		}
+
+		p.reconnect.attempts = attempts
+		p.reconnect.backoff = backoff
+		return nil
+	}
+}
+
+// reopenStream opens a new stream to pid for as long as we are connected to
+// it and attempts are left, and hands it to processLoop.
+func (p *PubSub) reopenStream(pid peer.ID) {
+	backoff := p.reconnect.backoff
+	for i := 1; i <= p.reconnect.attempts; i++ {
+		select {
+		case <-time.After(backoff):
+		case <-p.done:
+			return
+		}
+		backoff *= 2
+
+		h := p.Host()
+		if h.Network().Connectedness(pid) != inet.Connected {
+			p.log.Debugf("not reopening stream to %s: disconnected", pid)
+			return
+		}
+
+		s, err := h.NewStream(p.ctx, pid, p.protocols...)
+		if err != nil {
+			p.log.Warningf("reopening stream to %s (attempt %d of %d): %s", pid, i, p.reconnect.attempts, err)
+			continue
+		}
+
+		select {
+		case p.newPeers <- s:
+		case <-p.done:
+			s.Close()
+		}
+		return
+	}
+
+	p.log.Warningf("giving up reopening stream to %s", pid)
+}
@@ -0,0 +1,127 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+)
+
+// WithReplay delivers up to the last n messages delivered on the topic
+// before the subscription was made, so a subscriber joining a topic other
+// Subscriptions are already on doesn't miss what it just got. It also makes
+// us keep the last n messages of the topic for later subscriptions, while
+// we are subscribed to it. Messages arriving before any Subscription to the
+// topic aren't kept, as we don't receive them. n must not exceed the buffer
+// size of the subscription.
+func WithReplay(n int) SubOpt {
+	return func(sub *Subscription) error {
+		if n < 1 {
+			return fmt.Errorf("replay size must be positive, got %d", n)
+		}
+
+		sub.replay = n
+		return nil
+	}
+}
+
+// replayBuffer holds the last messages delivered on a topic
+type replayBuffer struct {
+	size int
+
+	// msgs holds up to size messages, the oldest at next once it is full
+	msgs []*Message
+	next int
+
+	// latest is the message added last
+	latest *pb.Message
+}
+
+// add records msg, evicting the oldest message if the buffer is full.
+func (b *replayBuffer) add(msg *Message) {
+	b.latest = msg.Message
+	if len(b.msgs) < b.size {
+		b.msgs = append(b.msgs, msg)
+		return
+	}
+
+	b.msgs[b.next] = msg
+	b.next = (b.next + 1) % b.size
+}
+
+// last returns up to the n latest messages, oldest first.
+func (b *replayBuffer) last(n int) []*Message {
+	ordered := append(append([]*Message(nil), b.msgs[b.next:]...), b.msgs[:b.next]...)
+	if len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// grow makes b keep at least n messages.
+func (b *replayBuffer) grow(n int) {
+	if n <= b.size {
+		return
+	}
+
+	b.msgs = b.last(b.size)
+	b.next = 0
+	b.size = n
+}
+
+// recordReplay keeps msg for replay to later Subscriptions to key, which is
+// the topic or wildcard it was delivered on. topic is the topic it matched.
+// Only called from processLoop.
+func (p *PubSub) recordReplay(key, topic string, msg *pb.Message, received time.Time) {
+	b, ok := p.replay[key]
+	if !ok {
+		return
+	}
+
+	// peers may repeat a topic within a message
+	if b.latest == msg {
+		return
+	}
+
+	b.add(&Message{Message: msg, MatchedTopic: topic, ReceivedAt: received})
+}
+
+// replayTo delivers the kept messages of the topics of sub to it, if it
+// asked for them, and makes us keep enough messages for it.
+// Only called from processLoop.
+func (p *PubSub) replayTo(sub *Subscription) {
+	if sub.replay == 0 {
+		return
+	}
+
+	// a message on several of the topics is replayed once
+	replayed := make(map[*pb.Message]struct{})
+	for _, topic := range sub.topics {
+		b, ok := p.replay[topic]
+		if !ok {
+			p.replay[topic] = &replayBuffer{size: sub.replay}
+			continue
+		}
+
+		for _, msg := range b.last(sub.replay) {
+			if _, ok := replayed[msg.Message]; ok {
+				continue
+			}
+			replayed[msg.Message] = struct{}{}
+
+			m := *msg
+			if !sub.accepts(&m) {
+				continue
+			}
+
+			// the subscriber doesn't have the Subscription yet, so
+			// waiting for it to make room would be in vain
+			select {
+			case sub.ch <- &m:
+			default:
+				count(&p.stats.DroppedSubscriberFull)
+			}
+		}
+		b.grow(sub.replay)
+	}
+}
@@ -0,0 +1,122 @@
+package floodsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// requestIDSize is the length in bytes of the random correlation IDs of
+// requests, enough for them not to collide
+const requestIDSize = 16
+
+// ErrMalformedRequest is returned by ParseRequest for messages which don't
+// carry a request
+var ErrMalformedRequest = errors.New("malformed request")
+
+// Request is a request published with PubSub.Request, as parsed by
+// ParseRequest
+type Request struct {
+	// ID correlates the request with its replies
+	ID []byte
+	// ReplyTopic is the topic the requester waits for the reply on
+	ReplyTopic string
+	// Data is the payload of the request
+	Data []byte
+}
+
+// Request publishes data as a request on topic and waits for the first reply
+// to it on replyTopic, which it subscribes to until a reply arrives or ctx
+// is done. Responders get the request with ParseRequest and answer with
+// Reply. The returned message is the reply with its data reduced to the
+// payload. Replies come from anyone publishing on replyTopic, so they need
+// to be validated like any message. Our subscription to replyTopic takes a
+// moment to reach our peers, and a reply sent before that is lost, so
+// responders right next to us should wait for it, as ListPeers tells.
+func (p *PubSub) Request(ctx context.Context, topic string, data []byte, replyTopic string) (*Message, error) {
+	id := make([]byte, requestIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("picking request id: %s", err)
+	}
+
+	// subscribe first, so we can't miss a quick reply
+	sub, err := p.SubscribeCtx(ctx, replyTopic)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Cancel()
+
+	payload := appendField(appendField(nil, id), []byte(replyTopic))
+	if err := p.Publish(topic, append(payload, data...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		rid, rdata, err := parseReply(msg.GetData())
+		if err != nil || string(rid) != string(id) {
+			// meant for someone else
+			continue
+		}
+
+		reply := *msg.Message
+		reply.Data = rdata
+		return &Message{Message: &reply, MatchedTopic: msg.MatchedTopic, ReceivedAt: msg.ReceivedAt}, nil
+	}
+}
+
+// ParseRequest returns the request carried by a message published with
+// PubSub.Request, or ErrMalformedRequest if it doesn't carry one.
+func ParseRequest(msg *Message) (*Request, error) {
+	id, rest, ok := readField(msg.GetData())
+	if !ok || len(id) != requestIDSize {
+		return nil, ErrMalformedRequest
+	}
+
+	topic, data, ok := readField(rest)
+	if !ok || len(topic) == 0 {
+		return nil, ErrMalformedRequest
+	}
+
+	return &Request{ID: id, ReplyTopic: string(topic), Data: data}, nil
+}
+
+// Reply publishes data as the reply to req on its reply topic.
+func (p *PubSub) Reply(req *Request, data []byte) error {
+	return p.Publish(req.ReplyTopic, append(appendField(nil, req.ID), data...))
+}
+
+// parseReply splits the data of a reply into the ID of the request it
+// answers and its payload.
+func parseReply(data []byte) ([]byte, []byte, error) {
+	id, rest, ok := readField(data)
+	if !ok || len(id) != requestIDSize {
+		return nil, nil, ErrMalformedRequest
+	}
+	return id, rest, nil
+}
+
+// appendField appends field to buf, prefixed with its length.
+func appendField(buf, field []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(field)))
+	return append(append(buf, l[:n]...), field...)
+}
+
+// readField returns the length prefixed field at the start of buf and what
+// follows it. It returns false if buf doesn't start with a field.
+func readField(buf []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || l > uint64(len(buf)-n) {
+		return nil, nil, false
+	}
+
+	end := n + int(l)
+	return buf[n:end], buf[end:], true
+}
@@ -0,0 +1,65 @@
+package floodsub
+
+import (
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerScore holds counters of the messages a peer sent us while connected.
+// It is the raw material for deciding whether to blacklist a peer; floodsub
+// doesn't act on it by itself.
+type PeerScore struct {
+	// Messages counts all messages the peer sent us
+	Messages uint64
+	// Delivered counts messages we saw first from the peer and which passed
+	// validation
+	Delivered uint64
+	// Duplicates counts messages the peer sent us after we had seen them,
+	// including messages we published
+	Duplicates uint64
+	// Invalid counts messages from the peer which were malformed or failed
+	// validation
+	Invalid uint64
+}
+
+type peerScoreReq struct {
+	peer peer.ID
+	resp chan PeerScore
+}
+
+// PeerScore returns the message counters of the given peer. They are reset
+// when the peer disconnects, and zero for peers we aren't connected to.
+func (p *PubSub) PeerScore(pid peer.ID) PeerScore {
+	out := make(chan PeerScore, 1)
+	select {
+	case p.getPeerScore <- &peerScoreReq{peer: pid, resp: out}:
+	case <-p.done:
+		return PeerScore{}
+	}
+	return <-out
+}
+
+// handlePeerScore replies with the score of the requested peer.
+// Only called from processLoop.
+func (p *PubSub) handlePeerScore(req *peerScoreReq) {
+	var score PeerScore
+	if s, ok := p.scores[req.peer]; ok {
+		score = *s
+	}
+	req.resp <- score
+}
+
+// scoreOf returns the score of pid, or nil if we aren't connected to it, e.g.
+// because pid is us.
+// Only called from processLoop.
+func (p *PubSub) scoreOf(pid peer.ID) *PeerScore {
+	if _, ok := p.peers[pid]; !ok {
+		return nil
+	}
+
+	s, ok := p.scores[pid]
+	if !ok {
+		s = new(PeerScore)
+		p.scores[pid] = s
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package floodsub
+
+import (
+	"container/list"
+	"fmt"
+
+	timecache "github.com/whyrusleeping/timecache"
+)
+
+// SeenCache remembers the IDs of the messages we have seen, for
+// deduplication. Add is only called for IDs Has returned false for. Both
+// are only called from the event loop, so implementations need not be
+// safe for concurrent use.
+//
+// Implementations may also have a Len() int method reporting the number of
+// IDs they hold, used by SeenCacheLen, and a Reset() method forgetting all
+// of them, used by FlushSeenCache.
+type SeenCache interface {
+	Has(id string) bool
+	Add(id string)
+}
+
+// WithSeenCache makes us remember seen messages in c instead of the default
+// time based cache, e.g. to keep them across restarts. The duration set with
+// WithMessageCacheDuration is ignored then.
+func WithSeenCache(c SeenCache) Option {
+	return func(p *PubSub) error {
+		if c == nil {
+			return fmt.Errorf("seen cache must not be nil")
+		}
+
+		p.seenMessages = c
+		p.newSeenCache = nil
+		return nil
+	}
+}
+
+// WithSeenCacheSize makes us remember the IDs of the last n messages we have
+// seen instead of those seen within the duration set with
+// WithMessageCacheDuration, evicting the least recently seen ones first.
+// This bounds the memory used by the cache regardless of the message rate,
+// but a burst of more than n messages lets old messages pass again.
+func WithSeenCacheSize(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("seen cache size must be positive, got %d", n)
+		}
+
+		p.newSeenCache = func() SeenCache {
+			return newLRUSeenCache(n)
+		}
+		p.seenMessages = p.newSeenCache()
+		return nil
+	}
+}
+
+// lruSeenCache is a SeenCache holding a fixed number of IDs
+type lruSeenCache struct {
+	size int
+
+	// order holds the IDs, most recently seen first
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newLRUSeenCache(size int) *lruSeenCache {
+	return &lruSeenCache{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lruSeenCache) Has(id string) bool {
+	e, ok := c.ids[id]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	return ok
+}
+
+func (c *lruSeenCache) Add(id string) {
+	if e, ok := c.ids[id]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.ids[id] = c.order.PushFront(id)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+}
+
+func (c *lruSeenCache) Len() int {
+	return c.order.Len()
+}
+
+type seenCacheReq struct {
+	flush bool
+	resp  chan int
+}
+
+// SeenCacheLen returns the number of message IDs in the seen message cache.
+// The default cache may still hold IDs older than the duration set with
+// WithMessageCacheDuration until it sees the next message. It returns -1
+// for a cache set with WithSeenCache without a Len method.
+func (p *PubSub) SeenCacheLen() int {
+	return p.seenCacheReq(false)
+}
+
+// FlushSeenCache forgets all messages we have seen, so messages arriving
+// again afterwards are delivered and forwarded as if they were new. A cache
+// set with WithSeenCache is only flushed if it has a Reset method. The cache
+// of WithContentDedup is kept.
+func (p *PubSub) FlushSeenCache() {
+	p.seenCacheReq(true)
+}
+
+func (p *PubSub) seenCacheReq(flush bool) int {
+	out := make(chan int, 1)
+	select {
+	case p.seenCacheCh <- &seenCacheReq{flush: flush, resp: out}:
+	case <-p.done:
+		return 0
+	}
+	return <-out
+}
+
+// handleSeenCache flushes the seen message cache if requested, and replies
+// with its length.
+// Only called from processLoop.
+func (p *PubSub) handleSeenCache(req *seenCacheReq) {
+	if req.flush {
+		if p.newSeenCache != nil {
+			p.seenMessages = p.newSeenCache()
+		} else if r, ok := p.seenMessages.(interface {
+			Reset()
+		}); ok {
+			r.Reset()
+		} else {
+			p.log.Warningf("not flushing seen message cache: it can't be reset")
+		}
+	}
+
+	req.resp <- seenCacheLen(p.seenMessages)
+}
+
+// seenCacheLen returns the number of IDs in c, or -1 if c doesn't tell.
+func seenCacheLen(c SeenCache) int {
+	switch c := c.(type) {
+	case *timecache.TimeCache:
+		return len(c.M)
+	case interface {
+		Len() int
+	}:
+		return c.Len()
+	default:
+		return -1
+	}
+}
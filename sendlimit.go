@@ -0,0 +1,54 @@
+package floodsub
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// WithMaxConcurrentSends limits the number of writes to peers in flight at
+// any time to n. Writers of other peers wait for a slot instead of writing,
+// which bounds the memory and file descriptor pressure of a broadcast storm.
+// Every time a writer has to wait is counted in Stats.ThrottledSends. Note
+// that a peer slow to read holds its slot for as long as its write takes,
+// delaying the sends to others.
+func WithMaxConcurrentSends(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("max concurrent sends must be positive, got %d", n)
+		}
+
+		p.sendSlots = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// acquireSend waits for a slot to write to a peer, and returns false if we
+// shut down first.
+func (p *PubSub) acquireSend() bool {
+	if p.sendSlots == nil {
+		return true
+	}
+
+	select {
+	case p.sendSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&p.stats.ThrottledSends, 1)
+	p.metrics.sendThrottled()
+
+	select {
+	case p.sendSlots <- struct{}{}:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// releaseSend frees the slot taken by acquireSend.
+func (p *PubSub) releaseSend() {
+	if p.sendSlots != nil {
+		<-p.sendSlots
+	}
+}
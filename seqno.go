@@ -0,0 +1,57 @@
+package floodsub
+
+import (
+	"encoding/binary"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// maxTrackedOrigins caps the number of origins whose last seqno we track, as
+// anyone can make up authors
+const maxTrackedOrigins = 4096
+
+type lastSeqnoReq struct {
+	peer peer.ID
+	resp chan lastSeqnoResp
+}
+
+type lastSeqnoResp struct {
+	seqno uint64
+	ok    bool
+}
+
+// LastSeqno returns the highest seqno of the messages we received from the
+// origin pid, whichever peer relayed them, e.g. to detect gaps in the
+// seqnos of a publisher. The bool is false if we haven't received an 8 byte
+// seqno from pid since it last disconnected from us.
+func (p *PubSub) LastSeqno(pid peer.ID) (uint64, bool) {
+	out := make(chan lastSeqnoResp, 1)
+	select {
+	case p.getLastSeqno <- &lastSeqnoReq{peer: pid, resp: out}:
+	case <-p.done:
+		return 0, false
+	}
+	resp := <-out
+	return resp.seqno, resp.ok
+}
+
+// trackSeqno records the seqno of pmsg if it is the highest of its origin.
+// Seqnos which aren't 8 bytes long aren't tracked.
+// Only called from processLoop.
+func (p *PubSub) trackSeqno(pmsg *pb.Message) {
+	if len(pmsg.GetSeqno()) != 8 {
+		return
+	}
+
+	origin := peer.ID(pmsg.GetFrom())
+	seqno := binary.BigEndian.Uint64(pmsg.GetSeqno())
+	last, ok := p.lastSeqnos[origin]
+	if !ok && len(p.lastSeqnos) >= maxTrackedOrigins {
+		return
+	}
+	if !ok || seqno > last {
+		p.lastSeqnos[origin] = seqno
+	}
+}
@@ -0,0 +1,133 @@
+package floodsub
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// shardQueueSize is the number of messages each worker shard may have in
+// flight before the event loop waits for results
+const shardQueueSize = 64
+
+// workerShards validates messages of peers on worker goroutines, one per
+// shard of the topics. The event loop keeps all other state; it hands
+// messages to the workers after the seen check and takes them back for
+// delivery and forwarding.
+type workerShards struct {
+	n int
+
+	// queues holds the jobs of each shard, nil unless the workers run.
+	// Each can hold all jobs in flight, so sending never blocks.
+	queues []chan *validationJob
+
+	// results returns validated jobs to the event loop. It can hold all
+	// jobs in flight, so workers never block on it.
+	results chan *validationJob
+
+	// inflight counts the jobs handed to workers and not taken back yet
+	inflight int
+}
+
+// validationJob is a message of a peer to validate on a worker
+type validationJob struct {
+	from     peer.ID
+	pmsg     *pb.Message
+	dmsg     *pb.Message
+	to       map[peer.ID]struct{}
+	received time.Time
+
+	// vals are the validators of the topics of the message when it was
+	// dispatched
+	vals  []topicValidator
+	valid bool
+}
+
+// WithWorkerShards validates the messages of our peers on n workers instead
+// of the event loop, so the validators of different topics run in
+// parallel. Messages are assigned to a worker by their first topic, so the
+// messages sharing it keep their order, while messages on other topics may
+// overtake them. A message on several topics is validated against all of
+// them by the worker of its first topic. Deduplication, delivery and
+// forwarding stay on the event loop, as do our own messages, whose
+// publishers may wait for the outcome.
+func WithWorkerShards(n int) Option {
+	return func(p *PubSub) error {
+		if n < 1 {
+			return fmt.Errorf("worker shards must be positive, got %d", n)
+		}
+
+		p.shards.n = n
+		return nil
+	}
+}
+
+// startShards starts the workers, if any.
+func (p *PubSub) startShards() {
+	if p.shards.n == 0 {
+		return
+	}
+
+	capacity := p.shards.n * shardQueueSize
+	p.shards.results = make(chan *validationJob, capacity)
+	p.shards.queues = make([]chan *validationJob, p.shards.n)
+	for i := range p.shards.queues {
+		q := make(chan *validationJob, capacity)
+		p.shards.queues[i] = q
+		go p.runShard(q, p.shards.results)
+	}
+}
+
+// runShard validates the jobs arriving on queue until it is closed.
+func (p *PubSub) runShard(queue <-chan *validationJob, results chan<- *validationJob) {
+	for job := range queue {
+		job.valid = p.runValidators(job.from, job.dmsg, job.vals)
+		results <- job
+	}
+}
+
+// stopShards stops the workers once they validated the jobs queued to them.
+// Their results are discarded.
+// Only called from processLoop.
+func (p *PubSub) stopShards() {
+	for _, q := range p.shards.queues {
+		close(q)
+	}
+	p.shards.queues = nil
+}
+
+// dispatchValidation queues job to the worker of its first topic. If too
+// many jobs are in flight, it first waits for workers to return some.
+// Only called from processLoop.
+func (p *PubSub) dispatchValidation(job *validationJob) {
+	for p.shards.inflight >= cap(p.shards.results) {
+		done := <-p.shards.results
+		p.shards.inflight--
+		p.handleValidated(done)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(job.dmsg.GetTopicIDs()[0]))
+	p.shards.inflight++
+	p.shards.queues[h.Sum32()%uint32(p.shards.n)] <- job
+}
+
+// handleValidated delivers and forwards a message returned by a worker if
+// it passed validation.
+// Only called from processLoop.
+func (p *PubSub) handleValidated(job *validationJob) {
+	if !job.valid {
+		count(&p.stats.DroppedValidation)
+		p.metrics.validationFailure()
+		if score := p.scoreOf(job.from); score != nil {
+			score.Invalid++
+		}
+		return
+	}
+
+	p.acceptMessage(job.from, job.pmsg, job.dmsg, job.to, job.received)
+}
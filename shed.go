@@ -0,0 +1,112 @@
+package floodsub
+
+import (
+	"fmt"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+)
+
+// TopicPriority tells which messages WithLoadShedding drops first
+type TopicPriority int
+
+const (
+	// PriorityLow topics are shed as soon as the incoming queue passes the
+	// high-water mark
+	PriorityLow TopicPriority = iota - 1
+	// PriorityNormal topics, the default, are only shed while the incoming
+	// queue is full
+	PriorityNormal
+	// PriorityHigh topics are never shed
+	PriorityHigh
+)
+
+// loadShedding configures dropping messages while the event loop falls
+// behind. The marks and priorities are only written by options, active only
+// by processLoop.
+type loadShedding struct {
+	high, low  int
+	priorities map[string]TopicPriority
+
+	// depth is the number of RPCs in the incoming queue when we took the
+	// last one
+	depth int
+	// active is set once the incoming queue passed high, until it drains
+	// below low
+	active bool
+}
+
+// WithLoadShedding drops messages from our peers while the event loop falls
+// behind, instead of letting them pile up. Once more than high RPCs are
+// waiting in the incoming queue, messages on PriorityLow topics are dropped
+// until fewer than low are left; while the queue is full, PriorityNormal
+// topics are dropped as well. Messages on a PriorityHigh topic are always
+// processed. Shed messages are counted in Stats.DroppedLoadShed. high can't
+// be larger than the size set with WithIncomingQueueSize.
+func WithLoadShedding(high, low int) Option {
+	return func(p *PubSub) error {
+		if low < 0 || high <= low {
+			return fmt.Errorf("load shedding marks must satisfy 0 <= low < high, got %d and %d", low, high)
+		}
+
+		p.shedding.high = high
+		p.shedding.low = low
+		return nil
+	}
+}
+
+// WithTopicPriority sets the priority of topic for WithLoadShedding. A
+// message on several topics has the highest priority of them.
+func WithTopicPriority(topic string, prio TopicPriority) Option {
+	return func(p *PubSub) error {
+		if prio < PriorityLow || prio > PriorityHigh {
+			return fmt.Errorf("invalid priority %d for topic %s", prio, topic)
+		}
+
+		p.shedding.priorities[topic] = prio
+		return nil
+	}
+}
+
+// updateShedding starts or stops shedding load given the number of RPCs in
+// the incoming queue.
+// Only called from processLoop.
+func (p *PubSub) updateShedding(depth int) {
+	s := &p.shedding
+	if s.high == 0 {
+		return
+	}
+
+	s.depth = depth
+	switch {
+	case !s.active && depth > s.high:
+		p.log.Warningf("incoming queue at %d RPCs, shedding low priority messages", depth)
+		s.active = true
+	case s.active && depth < s.low:
+		p.log.Infof("incoming queue down to %d RPCs, stopped shedding messages", depth)
+		s.active = false
+	}
+}
+
+// shedsMsg returns whether pmsg should be dropped to shed load.
+// Only called from processLoop.
+func (p *PubSub) shedsMsg(pmsg *pb.Message) bool {
+	if !p.shedding.active {
+		return false
+	}
+
+	prio := PriorityLow
+	for _, t := range pmsg.GetTopicIDs() {
+		if tp := p.shedding.priorities[t]; tp > prio {
+			prio = tp
+		}
+	}
+
+	switch prio {
+	case PriorityLow:
+		return true
+	case PriorityNormal:
+		return p.shedding.depth >= p.incomingSize
+	default:
+		return false
+	}
+}
@@ -0,0 +1,106 @@
+package floodsub
+
+import (
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultSlowPeerTimeout is how long the BlockSlowPeer policy waits for room
+// in the outbound queue of a peer by default
+const DefaultSlowPeerTimeout = time.Millisecond * 100
+
+// SlowPeerPolicy decides what happens to a message for a peer whose outbound
+// queue is full, i.e. which doesn't read as fast as we send.
+type SlowPeerPolicy int
+
+const (
+	// DropSlowPeerMessage discards the message for the peer, counting it in
+	// Stats.DroppedQueueFull. The peer misses it but stays connected.
+	DropSlowPeerMessage SlowPeerPolicy = iota
+	// DisconnectSlowPeer drops the message and disconnects the peer,
+	// counting it in Stats.DisconnectedSlowPeers, so it doesn't miss
+	// messages silently. It may connect again once it caught up. Direct
+	// peers are kept, and only miss the message.
+	DisconnectSlowPeer
+	// BlockSlowPeer waits for room in the queue of the peer, and drops the
+	// message if there is none within the slow peer timeout. While waiting
+	// the PubSub handles nothing else, so a slow peer slows down the
+	// delivery and forwarding of all messages.
+	BlockSlowPeer
+)
+
+// slowPeerPolicy configures what happens when the outbound queue of a peer
+// is full
+type slowPeerPolicy struct {
+	policy  SlowPeerPolicy
+	timeout time.Duration
+}
+
+// WithSlowPeerPolicy sets the policy applied when the outbound queue of a
+// peer is full. The default is DropSlowPeerMessage.
+func WithSlowPeerPolicy(policy SlowPeerPolicy) Option {
+	return func(p *PubSub) error {
+		switch policy {
+		case DropSlowPeerMessage, DisconnectSlowPeer, BlockSlowPeer:
+		default:
+			return fmt.Errorf("unknown slow peer policy %d", policy)
+		}
+
+		p.slowPeers.policy = policy
+		return nil
+	}
+}
+
+// WithSlowPeerTimeout sets how long the BlockSlowPeer policy waits for a
+// peer. It defaults to DefaultSlowPeerTimeout.
+func WithSlowPeerTimeout(d time.Duration) Option {
+	return func(p *PubSub) error {
+		if d <= 0 {
+			return fmt.Errorf("slow peer timeout must be positive, got %s", d)
+		}
+
+		p.slowPeers.timeout = d
+		return nil
+	}
+}
+
+// sendToPeer queues out to the peer pid with queue mch, applying the slow
+// peer policy if the queue is full. It returns whether out was queued.
+// Only called from processLoop.
+func (p *PubSub) sendToPeer(pid peer.ID, mch chan *RPC, out *RPC) bool {
+	select {
+	case mch <- out:
+		return true
+	default:
+	}
+
+	switch p.slowPeers.policy {
+	case BlockSlowPeer:
+		timer := time.NewTimer(p.slowPeers.timeout)
+		defer timer.Stop()
+
+		select {
+		case mch <- out:
+			return true
+		case <-timer.C:
+		}
+	case DisconnectSlowPeer:
+		if _, ok := p.directPeers[pid]; ok {
+			break
+		}
+
+		p.log.Infof("disconnecting slow peer %s: queue full", pid)
+		count(&p.stats.DisconnectedSlowPeers)
+		p.handleDeadPeer(pid)
+
+		// closing the connection may block, but must not hold up the
+		// event loop
+		go p.host.Network().ClosePeer(pid)
+	}
+
+	p.log.Infof("dropping message to peer %s: queue full", pid)
+	count(&p.stats.DroppedQueueFull)
+	return false
+}
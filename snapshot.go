@@ -0,0 +1,90 @@
+package floodsub
+
+import (
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Snapshot is the state of a PubSub at one point in time, for debugging
+type Snapshot struct {
+	// Topics maps the topics we are subscribed to to their number of
+	// Subscriptions
+	Topics map[string]int
+	// PeerTopics maps the peers we are connected to to the topics they
+	// are subscribed to
+	PeerTopics map[peer.ID][]string
+	// Peers is the number of peers we are connected to
+	Peers int
+	// SeenMessages is the number of IDs in the seen message cache, as
+	// returned by SeenCacheLen
+	SeenMessages int
+}
+
+type snapshotReq struct {
+	resp chan Snapshot
+}
+
+// DebugSnapshot returns the state of the PubSub, taken at once by the event
+// loop so it is consistent. It copies all of it, so it is meant for
+// debugging rather than for frequent calls.
+func (p *PubSub) DebugSnapshot() Snapshot {
+	out := make(chan Snapshot, 1)
+	select {
+	case p.getSnapshot <- &snapshotReq{resp: out}:
+	case <-p.done:
+		return Snapshot{}
+	}
+	return <-out
+}
+
+// handleSnapshot replies with the current state.
+// Only called from processLoop.
+func (p *PubSub) handleSnapshot(req *snapshotReq) {
+	s := Snapshot{
+		Topics:       p.subscriberCounts(),
+		PeerTopics:   make(map[peer.ID][]string, len(p.peers)),
+		Peers:        len(p.peers),
+		SeenMessages: seenCacheLen(p.seenMessages),
+	}
+
+	for pid := range p.peers {
+		s.PeerTopics[pid] = nil
+	}
+	for topic, tmap := range p.topics {
+		for pid := range tmap {
+			if _, ok := s.PeerTopics[pid]; ok {
+				s.PeerTopics[pid] = append(s.PeerTopics[pid], topic)
+			}
+		}
+	}
+
+	req.resp <- s
+}
+
+type subCountsReq struct {
+	resp chan map[string]int
+}
+
+// LocalSubscriberCounts returns the number of our Subscriptions to each
+// topic we are subscribed to, e.g. to spot Subscriptions which are never
+// cancelled. A Subscription to several topics counts for each of them, and
+// those made with SubscribeAll aren't counted.
+func (p *PubSub) LocalSubscriberCounts() map[string]int {
+	out := make(chan map[string]int, 1)
+	select {
+	case p.getSubCounts <- &subCountsReq{resp: out}:
+	case <-p.done:
+		return nil
+	}
+	return <-out
+}
+
+// subscriberCounts returns the number of Subscriptions to each of our
+// topics.
+// Only called from processLoop.
+func (p *PubSub) subscriberCounts() map[string]int {
+	counts := make(map[string]int, len(p.myTopics))
+	for topic, subs := range p.myTopics {
+		counts[topic] = len(subs)
+	}
+	return counts
+}
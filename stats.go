@@ -0,0 +1,110 @@
+package floodsub
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds counters of the messages processed by a PubSub since it was
+// created
+type Stats struct {
+	// Published counts messages published by this node
+	Published uint64
+	// Received counts messages received from our peers
+	Received uint64
+	// Forwarded counts messages sent to our peers, once per peer
+	Forwarded uint64
+	// DroppedSeen counts messages dropped because we had seen them before
+	DroppedSeen uint64
+	// DroppedNotSubscribed counts messages received for topics we aren't
+	// subscribed to
+	DroppedNotSubscribed uint64
+	// DroppedValidation counts messages which failed a topic validator
+	DroppedValidation uint64
+	// DroppedQueueFull counts messages not sent to a peer because its
+	// outbound queue was full
+	DroppedQueueFull uint64
+	// DroppedSubscriberFull counts messages not delivered to a local
+	// Subscription because its buffer was full
+	DroppedSubscriberFull uint64
+	// DroppedPeerGone counts messages queued to a peer which couldn't be
+	// sent before it went away
+	DroppedPeerGone uint64
+	// DroppedRateLimited counts messages from peers exceeding the limit set
+	// with WithPeerRateLimit
+	DroppedRateLimited uint64
+	// DroppedContentDup counts messages suppressed by WithContentDedup
+	DroppedContentDup uint64
+	// DroppedLoadShed counts messages dropped by WithLoadShedding
+	DroppedLoadShed uint64
+	// RejectedSubscriptions counts topic subscriptions of peers ignored
+	// because of WithMaxTopicsPerPeer, or for invalid topics
+	RejectedSubscriptions uint64
+	// DroppedDecryption counts messages on encrypted topics which failed to
+	// decrypt
+	DroppedDecryption uint64
+	// DroppedCompression counts messages which failed to decompress, and
+	// messages compressed with a codec we don't know, which we relay but
+	// don't deliver
+	DroppedCompression uint64
+	// ThrottledSends counts writes to peers which had to wait because of
+	// WithMaxConcurrentSends
+	ThrottledSends uint64
+	// DroppedFragments counts fragments which were invalid, or whose
+	// message wasn't complete within the fragment timeout
+	DroppedFragments uint64
+	// DroppedOutOfOrder counts messages arriving too late for
+	// WithOrderedDelivery
+	DroppedOutOfOrder uint64
+	// DroppedMalformed counts messages from peers without topics, with
+	// empty or overlong topics, or with seqnos of the wrong length
+	DroppedMalformed uint64
+	// DroppedInvalidFrom counts messages from peers whose author isn't a
+	// valid peer ID
+	DroppedInvalidFrom uint64
+	// DroppedObserverFull counts messages not passed to the observer set
+	// with WithMessageObserver because it fell behind
+	DroppedObserverFull uint64
+	// DroppedLoopback counts messages published by us which peers sent
+	// back to us
+	DroppedLoopback uint64
+	// DisconnectedSlowPeers counts peers disconnected by the
+	// DisconnectSlowPeer policy
+	DisconnectedSlowPeers uint64
+	// WriteRetries counts writes to peers retried after a temporary error
+	WriteRetries uint64
+}
+
+// Stats returns a snapshot of the message counters
+func (p *PubSub) Stats() Stats {
+	return Stats{
+		Published:             atomic.LoadUint64(&p.stats.Published),
+		Received:              atomic.LoadUint64(&p.stats.Received),
+		Forwarded:             atomic.LoadUint64(&p.stats.Forwarded),
+		DroppedSeen:           atomic.LoadUint64(&p.stats.DroppedSeen),
+		DroppedNotSubscribed:  atomic.LoadUint64(&p.stats.DroppedNotSubscribed),
+		DroppedValidation:     atomic.LoadUint64(&p.stats.DroppedValidation),
+		DroppedQueueFull:      atomic.LoadUint64(&p.stats.DroppedQueueFull),
+		DroppedSubscriberFull: atomic.LoadUint64(&p.stats.DroppedSubscriberFull),
+		DroppedPeerGone:       atomic.LoadUint64(&p.stats.DroppedPeerGone),
+		DroppedRateLimited:    atomic.LoadUint64(&p.stats.DroppedRateLimited),
+		DroppedContentDup:     atomic.LoadUint64(&p.stats.DroppedContentDup),
+		DroppedLoadShed:       atomic.LoadUint64(&p.stats.DroppedLoadShed),
+		RejectedSubscriptions: atomic.LoadUint64(&p.stats.RejectedSubscriptions),
+		DroppedDecryption:     atomic.LoadUint64(&p.stats.DroppedDecryption),
+		DroppedCompression:    atomic.LoadUint64(&p.stats.DroppedCompression),
+		ThrottledSends:        atomic.LoadUint64(&p.stats.ThrottledSends),
+		DroppedFragments:      atomic.LoadUint64(&p.stats.DroppedFragments),
+		DroppedOutOfOrder:     atomic.LoadUint64(&p.stats.DroppedOutOfOrder),
+		DroppedMalformed:      atomic.LoadUint64(&p.stats.DroppedMalformed),
+		DroppedInvalidFrom:    atomic.LoadUint64(&p.stats.DroppedInvalidFrom),
+		DroppedObserverFull:   atomic.LoadUint64(&p.stats.DroppedObserverFull),
+		DroppedLoopback:       atomic.LoadUint64(&p.stats.DroppedLoopback),
+		DisconnectedSlowPeers: atomic.LoadUint64(&p.stats.DisconnectedSlowPeers),
+		WriteRetries:          atomic.LoadUint64(&p.stats.WriteRetries),
+	}
+}
+
+// count atomically increments one of the counters in p.stats
+func count(c *uint64) {
+	atomic.AddUint64(c, 1)
+}
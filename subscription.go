@@ -2,19 +2,142 @@ package floodsub
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 )
 
+// ErrSubscriptionCancelled is returned by Next once a Subscription has been
+// cancelled and all messages buffered before the cancellation were consumed
+var ErrSubscriptionCancelled = errors.New("subscription cancelled")
+
+// DefaultSubscriptionBufferSize is the number of messages a Subscription
+// buffers by default
+const DefaultSubscriptionBufferSize = 32
+
+// DefaultDeliveryTimeout is how long the BlockWithTimeout policy waits for a
+// subscriber to make room for a message by default
+const DefaultDeliveryTimeout = time.Millisecond * 100
+
+// DeliveryPolicy decides what happens to a message arriving on a Subscription
+// whose buffer is full, i.e. whose consumer doesn't keep up.
+type DeliveryPolicy int
+
+const (
+	// DropNewest discards the arriving message. The subscriber sees the
+	// oldest messages and misses the latest ones.
+	DropNewest DeliveryPolicy = iota
+	// DropOldest discards the oldest buffered message to make room for the
+	// arriving one. The subscriber misses old messages, which suits
+	// consumers that only care about the current state.
+	DropOldest
+	// BlockWithTimeout waits for the subscriber to consume a message, and
+	// drops the arriving one if it doesn't within the delivery timeout.
+	// No message is lost to short bursts, but while waiting the PubSub
+	// handles nothing else, so a slow subscriber slows down the delivery
+	// and forwarding of messages on every topic.
+	BlockWithTimeout
+)
+
+// SubOpt is an option for a Subscription
+type SubOpt func(*Subscription) error
+
+// WithBufferSize sets the number of messages the subscription buffers for its
+// consumer. Larger buffers absorb bursts at the cost of memory and latency.
+// It defaults to DefaultSubscriptionBufferSize.
+func WithBufferSize(n int) SubOpt {
+	return func(sub *Subscription) error {
+		if n < 1 {
+			return fmt.Errorf("buffer size must be positive, got %d", n)
+		}
+
+		sub.bufSize = n
+		return nil
+	}
+}
+
+// WithDeliveryPolicy sets the policy applied when the subscription's buffer
+// is full. The default is DropNewest.
+func WithDeliveryPolicy(policy DeliveryPolicy) SubOpt {
+	return func(sub *Subscription) error {
+		switch policy {
+		case DropNewest, DropOldest, BlockWithTimeout:
+		default:
+			return fmt.Errorf("unknown delivery policy %d", policy)
+		}
+
+		sub.policy = policy
+		return nil
+	}
+}
+
+// WithDeliveryTimeout sets how long the BlockWithTimeout policy waits for the
+// subscriber. It defaults to DefaultDeliveryTimeout.
+func WithDeliveryTimeout(d time.Duration) SubOpt {
+	return func(sub *Subscription) error {
+		if d <= 0 {
+			return fmt.Errorf("delivery timeout must be positive, got %s", d)
+		}
+
+		sub.timeout = d
+		return nil
+	}
+}
+
+// WithFilter makes the subscription deliver only the messages for which fn
+// returns true. Other messages are skipped before they take up room in the
+// buffer, and aren't replayed either. fn is called from the event loop of
+// the PubSub, so it must be fast and must not call into the PubSub.
+func WithFilter(fn func(*Message) bool) SubOpt {
+	return func(sub *Subscription) error {
+		if fn == nil {
+			return fmt.Errorf("filter must not be nil")
+		}
+
+		sub.filter = fn
+		return nil
+	}
+}
+
+// Subscription is a handle to the messages arriving on a topic we subscribed to
 type Subscription struct {
-	topic    string
+	// topics is empty for a Subscription made with SubscribeAll
+	topics   []string
+	joined   *Topic
 	ch       chan *Message
 	cancelCh chan<- *Subscription
+	done     <-chan struct{}
 	err      error
+
+	cancelOnce sync.Once
+
+	bufSize int
+	policy  DeliveryPolicy
+	timeout time.Duration
+	replay  int
+	filter  func(*Message) bool
 }
 
+// Topic returns the topic of the subscription. For a subscription to several
+// topics it is the first of them, and for one made with SubscribeAll it is
+// empty.
 func (sub *Subscription) Topic() string {
-	return sub.topic
+	if len(sub.topics) == 0 {
+		return ""
+	}
+	return sub.topics[0]
+}
+
+// Topics returns the topics of the subscription
+func (sub *Subscription) Topics() []string {
+	return append([]string(nil), sub.topics...)
 }
 
+// Next blocks until the next message arrives on the subscription and returns
+// it. It returns ctx.Err() if ctx is done first, and ErrSubscriptionCancelled
+// after the subscription has been cancelled. Next must not be called from
+// several goroutines at once.
 func (sub *Subscription) Next(ctx context.Context) (*Message, error) {
 	select {
 	case msg, ok := <-sub.ch:
@@ -28,6 +151,75 @@ func (sub *Subscription) Next(ctx context.Context) (*Message, error) {
 	}
 }
 
+// Cancel cancels the subscription. Pending and future calls to Next return
+// ErrSubscriptionCancelled. Cancel may be called any number of times, also
+// concurrently and after the PubSub was closed.
 func (sub *Subscription) Cancel() {
-	sub.cancelCh <- sub
+	sub.cancelOnce.Do(func() {
+		select {
+		case sub.cancelCh <- sub:
+		case <-sub.done:
+			// the PubSub is gone and already cancelled us
+		}
+	})
+}
+
+// Drain cancels the subscription like Cancel and returns the messages which
+// were buffered for it, oldest first, e.g. to hand them over before
+// shutting down a consumer. They are returned once the PubSub stopped
+// delivering to the subscription, so no message is lost in between. Next
+// must not be called concurrently.
+func (sub *Subscription) Drain() []*Message {
+	sub.Cancel()
+
+	// the channel is closed once the PubSub is done with the subscription
+	var msgs []*Message
+	for msg := range sub.ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// accepts returns whether msg passes the filter of the subscription.
+// Only called from processLoop.
+func (sub *Subscription) accepts(msg *Message) bool {
+	return sub.filter == nil || sub.filter(msg)
+}
+
+// deliver hands msg to the subscriber according to the delivery policy and
+// returns false if a message had to be dropped.
+// Only called from processLoop.
+func (sub *Subscription) deliver(msg *Message) bool {
+	select {
+	case sub.ch <- msg:
+		return true
+	default:
+	}
+
+	switch sub.policy {
+	case DropOldest:
+		select {
+		case <-sub.ch:
+		default:
+		}
+
+		// processLoop is the only sender, so there is room now
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+		return false
+	case BlockWithTimeout:
+		timer := time.NewTimer(sub.timeout)
+		defer timer.Stop()
+
+		select {
+		case sub.ch <- msg:
+			return true
+		case <-timer.C:
+			return false
+		}
+	default:
+		return false
+	}
 }
@@ -0,0 +1,124 @@
+package floodsub
+
+import (
+	"context"
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Topic is a handle to a topic we joined with Join, to publish and subscribe
+// to it without repeating its name.
+type Topic struct {
+	p     *PubSub
+	topic string
+
+	// refs counts the Join calls not undone by Close yet, guarded by
+	// p.joinedLk
+	refs int
+
+	// left is set by processLoop once the handle is closed for good
+	left bool
+}
+
+// Join returns the handle for the given topic. Joining a topic we joined
+// already returns the same handle, and each Join must be matched by a call
+// to Close.
+func (p *PubSub) Join(topic string) (*Topic, error) {
+	if err := p.checkTopics([]string{topic}); err != nil {
+		return nil, fmt.Errorf("cannot join topic: %s", err)
+	}
+
+	select {
+	case <-p.done:
+		return nil, p.closedErr()
+	default:
+	}
+
+	p.joinedLk.Lock()
+	defer p.joinedLk.Unlock()
+
+	t, ok := p.joined[topic]
+	if !ok {
+		t = &Topic{p: p, topic: topic}
+		p.joined[topic] = t
+	}
+	t.refs++
+	return t, nil
+}
+
+// String returns the name of the topic
+func (t *Topic) String() string {
+	return t.topic
+}
+
+// Publish publishes data to the topic
+func (t *Topic) Publish(data []byte) error {
+	if err := t.checkJoined(); err != nil {
+		return err
+	}
+	return t.p.Publish(t.topic, data)
+}
+
+// Subscribe returns a new Subscription for the topic. It is cancelled when
+// the topic is closed.
+func (t *Topic) Subscribe(opts ...SubOpt) (*Subscription, error) {
+	if err := t.checkJoined(); err != nil {
+		return nil, err
+	}
+	return t.p.subscribeTopics(context.Background(), []string{t.topic}, t, opts)
+}
+
+// ListPeers returns the peers we are connected to which are subscribed to
+// the topic.
+func (t *Topic) ListPeers() []peer.ID {
+	return t.p.ListPeers(t.topic)
+}
+
+// Close undoes a call to Join. When all of them are undone, it cancels the
+// Subscriptions made through the handle, leaving the topic unless we
+// subscribed to it otherwise, and the handle can't be used anymore.
+func (t *Topic) Close() error {
+	t.p.joinedLk.Lock()
+	if t.refs == 0 {
+		t.p.joinedLk.Unlock()
+		return fmt.Errorf("topic %s already closed", t.topic)
+	}
+
+	t.refs--
+	if t.refs > 0 {
+		t.p.joinedLk.Unlock()
+		return nil
+	}
+	delete(t.p.joined, t.topic)
+	t.p.joinedLk.Unlock()
+
+	select {
+	case t.p.leave <- t:
+	case <-t.p.done:
+		// the PubSub is gone and already cancelled our subscriptions
+	}
+	return nil
+}
+
+// checkJoined returns an error if the handle was closed.
+func (t *Topic) checkJoined() error {
+	t.p.joinedLk.Lock()
+	defer t.p.joinedLk.Unlock()
+
+	if t.refs == 0 {
+		return fmt.Errorf("topic %s already closed", t.topic)
+	}
+	return nil
+}
+
+// handleLeave cancels the Subscriptions made through the closed handle t.
+// Only called from processLoop.
+func (p *PubSub) handleLeave(t *Topic) {
+	t.left = true
+	for sub := range p.myTopics[t.topic] {
+		if sub.joined == t {
+			p.removeSubscription(sub)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package floodsub
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/libp2p/go-floodsub/pb"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ErrValidationFailed is returned by PublishValidated for messages failing
+// validation
+var ErrValidationFailed = errors.New("message failed validation")
+
+// Validator is a function that validates a message published on a topic.
+// It receives the peer that sent us the message and returns false if the
+// message should be dropped. Validators run inside the event loop, so they
+// must be fast and must not block. With WithWorkerShards, they run on the
+// workers for messages of peers, and must be safe for concurrent use.
+type Validator func(peer.ID, *Message) bool
+
+type addValReq struct {
+	topic    string
+	validate Validator
+	resp     chan error
+}
+
+type rmValReq struct {
+	topic string
+	resp  chan error
+}
+
+// RegisterTopicValidator registers a validator for messages on topic.
+// Messages failing validation are neither delivered to local subscribers
+// nor forwarded to our peers. Only one validator per topic is allowed.
+func (p *PubSub) RegisterTopicValidator(topic string, v Validator) error {
+	if v == nil {
+		return fmt.Errorf("validator for topic %s must not be nil", topic)
+	}
+
+	out := make(chan error, 1)
+	select {
+	case p.addVal <- &addValReq{
+		topic:    topic,
+		validate: v,
+		resp:     out,
+	}:
+	case <-p.done:
+		return p.closedErr()
+	}
+
+	return <-out
+}
+
+// UnregisterTopicValidator removes the validator registered for topic.
+func (p *PubSub) UnregisterTopicValidator(topic string) error {
+	out := make(chan error, 1)
+	select {
+	case p.rmVal <- &rmValReq{
+		topic: topic,
+		resp:  out,
+	}:
+	case <-p.done:
+		return p.closedErr()
+	}
+
+	return <-out
+}
+
+// handleAddValidator installs a topic validator.
+// Only called from processLoop.
+func (p *PubSub) handleAddValidator(req *addValReq) {
+	if _, ok := p.topicVals[req.topic]; ok {
+		req.resp <- fmt.Errorf("duplicate validator for topic %s", req.topic)
+		return
+	}
+
+	p.topicVals[req.topic] = req.validate
+	req.resp <- nil
+}
+
+// handleRemoveValidator removes a topic validator.
+// Only called from processLoop.
+func (p *PubSub) handleRemoveValidator(req *rmValReq) {
+	if _, ok := p.topicVals[req.topic]; !ok {
+		req.resp <- fmt.Errorf("no validator for topic %s", req.topic)
+		return
+	}
+
+	delete(p.topicVals, req.topic)
+	req.resp <- nil
+}
+
+// topicValidator is the validator registered for a topic
+type topicValidator struct {
+	topic    string
+	validate Validator
+}
+
+// validate runs the validators of all topics of a message and returns whether
+// the message passed all of them.
+// Only called from processLoop.
+func (p *PubSub) validate(from peer.ID, pmsg *pb.Message) bool {
+	return p.runValidators(from, pmsg, p.validatorsFor(pmsg))
+}
+
+// validatorsFor returns the validators of the topics of pmsg.
+// Only called from processLoop.
+func (p *PubSub) validatorsFor(pmsg *pb.Message) []topicValidator {
+	var vals []topicValidator
+	for _, t := range pmsg.GetTopicIDs() {
+		if v, ok := p.topicVals[t]; ok {
+			vals = append(vals, topicValidator{topic: t, validate: v})
+		}
+	}
+	return vals
+}
+
+// runValidators returns whether pmsg passes all of vals.
+func (p *PubSub) runValidators(from peer.ID, pmsg *pb.Message, vals []topicValidator) bool {
+	for _, v := range vals {
+		if !v.validate(from, &Message{Message: pmsg}) {
+			p.log.Debugf("message from %s failed validation for topic %s", from, v.topic)
+			return false
+		}
+	}
+	return true
+}